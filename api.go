@@ -0,0 +1,308 @@
+package donkeytownsfolk
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiError is the JSON body returned for any /api/v1 failure.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeApiJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeApiError(w http.ResponseWriter, status int, err error) {
+	writeApiJson(w, status, apiError{err.Error()})
+}
+
+// jsonBodyKey is the request context key decodeJsonBody stashes a decoded
+// body under, for formValue to read back.
+type jsonBodyKey struct{}
+
+// decodeJsonBody reads r's body as a JSON object into r's context when the
+// client declared "Content-Type: application/json", so formValue can serve
+// fields from a JSON body the same way it serves them from a form-encoded
+// one. Requests with any other (or no) Content-Type are left untouched.
+func decodeJsonBody(r *http.Request) (*http.Request, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return r, nil
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), jsonBodyKey{}, body)), nil
+}
+
+// formValue reads key from the JSON body decodeJsonBody stashed on r, falling
+// back to r.FormValue(key) for traditional form-encoded requests. This lets
+// every API write handler accept either encoding without caring which one a
+// given client used.
+func formValue(r *http.Request, key string) string {
+	body, ok := r.Context().Value(jsonBodyKey{}).(map[string]interface{})
+	if !ok {
+		return r.FormValue(key)
+	}
+	v := body[key]
+	if v == nil {
+		return ""
+	}
+	if b, ok := v.(bool); ok {
+		if b {
+			return "true"
+		}
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// apiHandler is like the html createHandler, but writes JSON responses with proper
+// status codes instead of redirecting to an error page.
+type apiHandler func(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error)
+
+// requireApiToken wraps an apiHandler with bearer-token authentication: the caller
+// must send "Authorization: Bearer <token>" matching a user's current ApiToken.
+func requireApiToken(db *Db, f apiHandler) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			writeApiError(w, http.StatusUnauthorized, UserNotFoundError)
+			return
+		}
+
+		tok, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			writeApiError(w, http.StatusUnauthorized, UserNotFoundError)
+			return
+		}
+
+		user, err := db.FindUserByApiToken(tok)
+		if err != nil {
+			writeApiError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		r, err = decodeJsonBody(r)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		body, status, err := f(w, r, db, user)
+		if err != nil {
+			writeApiError(w, status, err)
+			return
+		}
+		if body != nil {
+			writeApiJson(w, status, body)
+		} else {
+			w.WriteHeader(status)
+		}
+	}
+}
+
+// setupApiRoutes wires up the /api/v1 JSON surface, alongside the HTML handlers
+// registered by SetupRenderer. It lets scripts and third-party tools import/export
+// decklists without going through the browser cookie flow.
+func setupApiRoutes(db *Db, s *mux.Router) {
+	api := s.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/tokens", performIssueApiToken(db)).Methods("POST")
+
+	api.HandleFunc("/users/{user}/decks", requireApiToken(db, apiListDecks)).Methods("GET")
+	api.HandleFunc("/users/{user}/decks", requireApiToken(db, apiCreateDeck)).Methods("POST")
+	api.HandleFunc("/users/{user}/decks/{deck}", requireApiToken(db, apiGetDeck)).Methods("GET")
+	api.HandleFunc("/users/{user}/decks/{deck}", requireApiToken(db, apiUpdateDeck)).Methods("PUT")
+	api.HandleFunc("/users/{user}/decks/{deck}", requireApiToken(db, apiDeleteDeck)).Methods("DELETE")
+	api.HandleFunc("/users/{user}/decks/{deck}/snapshots", requireApiToken(db, apiListSnapshots)).Methods("GET")
+	api.HandleFunc("/users/{user}/decks/{deck}/snapshots", requireApiToken(db, apiSaveSnapshot)).Methods("POST")
+}
+
+// performIssueApiToken exchanges a username/password (form-encoded or JSON,
+// same fields as performLogin) for a bearer token, the API equivalent of the
+// cookie session that performLogin grants browser clients.
+func performIssueApiToken(db *Db) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, err := decodeJsonBody(r)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		username := formValue(r, "username")
+		password := formValue(r, "password")
+
+		if username == "" || password == "" {
+			writeApiError(w, http.StatusBadRequest, UserNotFoundError)
+			return
+		}
+
+		user, err := db.FindUser(username)
+		if err != nil {
+			writeApiError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)); err != nil {
+			writeApiError(w, http.StatusUnauthorized, UserNotFoundError)
+			return
+		}
+
+		user.ApiToken = securecookie.GenerateRandomKey(32)
+		if err := db.UpdateUser(user); err != nil {
+			writeApiError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeApiJson(w, http.StatusOK, struct {
+			Token string `json:"token"`
+		}{base64.URLEncoding.EncodeToString(user.ApiToken)})
+	}
+}
+
+// requireOwnUser ensures the authenticated user matches the {user} path segment -
+// the API only lets you manage your own decks, same as the HTML handlers which key
+// off the logged-in session.
+func requireOwnUser(r *http.Request, user *User) error {
+	if normalizeString(mux.Vars(r)["user"]) != user.NormalizedName {
+		return UserNotFoundError
+	}
+	return nil
+}
+
+func apiListDecks(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error) {
+	if err := requireOwnUser(r, user); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	return user.AllDecks(), http.StatusOK, nil
+}
+
+func apiCreateDeck(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error) {
+	if err := requireOwnUser(r, user); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	priceInt, err := strconv.Atoi(formValue(r, "price"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	var deck *Deck
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d, err := addDeckService(u, formValue(r, "name"), Money(priceInt))
+		deck = d
+		return err
+	})
+	if err != nil {
+		return nil, http.StatusConflict, err
+	}
+	return deck, http.StatusCreated, nil
+}
+
+func apiGetDeck(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error) {
+	if err := requireOwnUser(r, user); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	deck := user.FindDeck(mux.Vars(r)["deck"])
+	if deck == nil {
+		return nil, http.StatusNotFound, UserNotFoundError
+	}
+	return deck, http.StatusOK, nil
+}
+
+func apiUpdateDeck(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error) {
+	if err := requireOwnUser(r, user); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	deckName := mux.Vars(r)["deck"]
+	if user.FindDeck(deckName) == nil {
+		return nil, http.StatusNotFound, UserNotFoundError
+	}
+
+	var deck *Deck
+	_, err := db.UpdateUserFunc(user.Name, func(u *User) error {
+		deck = u.FindDeck(deckName)
+		if deck == nil {
+			return UserNotFoundError
+		}
+		return updateDecklistService(
+			db,
+			deck,
+			strings.TrimSpace(formValue(r, "commander")),
+			formValue(r, "decklist"),
+			formValue(r, "sideboard"),
+			formValue(r, "grandfather") != "")
+	})
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return deck, http.StatusOK, nil
+}
+
+func apiDeleteDeck(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error) {
+	if err := requireOwnUser(r, user); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	deckName := mux.Vars(r)["deck"]
+	_, err := db.UpdateUserFunc(user.Name, func(u *User) error {
+		_, err := deleteDeckService(u, deckName)
+		return err
+	})
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	return nil, http.StatusNoContent, nil
+}
+
+func apiListSnapshots(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error) {
+	if err := requireOwnUser(r, user); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	deck := user.FindDeck(mux.Vars(r)["deck"])
+	if deck == nil {
+		return nil, http.StatusNotFound, UserNotFoundError
+	}
+	return deck.Snapshots, http.StatusOK, nil
+}
+
+func apiSaveSnapshot(w http.ResponseWriter, r *http.Request, db *Db, user *User) (interface{}, int, error) {
+	if err := requireOwnUser(r, user); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	deckName := mux.Vars(r)["deck"]
+	if user.FindDeck(deckName) == nil {
+		return nil, http.StatusNotFound, UserNotFoundError
+	}
+
+	var snap *Snapshot
+	_, err := db.UpdateUserFunc(user.Name, func(u *User) error {
+		d := u.FindDeck(deckName)
+		if d == nil {
+			return UserNotFoundError
+		}
+		snap = saveSnapshotService(d)
+		return nil
+	})
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	return snap, http.StatusCreated, nil
+}
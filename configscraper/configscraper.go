@@ -0,0 +1,273 @@
+// Package configscraper lets operators define new donkeytownsfolk price sources in
+// a YAML file instead of Go code, so adding a new card shop doesn't require
+// recompiling the server.
+package configscraper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/garbotron/donkeytownsfolk"
+	"gopkg.in/yaml.v2"
+)
+
+// SourceConfig describes a single scrapeable shop. IndexSelector yields links to
+// the pages that actually list cards (e.g. one per set); RowSelector/NameSelector/
+// PriceSelector then walk each of those pages. NameRegex/PriceRegex, if set, are
+// applied to the selected text before further processing (e.g. to strip a set code
+// out of a combined name/set column).
+type SourceConfig struct {
+	Name             string `yaml:"name"`
+	BaseUrl          string `yaml:"base_url"`
+	IndexSelector    string `yaml:"index_selector"`
+	RowSelector      string `yaml:"row_selector"`
+	NameSelector     string `yaml:"name_selector"`
+	PriceSelector    string `yaml:"price_selector"`
+	NameRegex        string `yaml:"name_regex"`
+	PriceRegex       string `yaml:"price_regex"`
+	NextPageSelector string `yaml:"next_page_selector"`
+	RequestDelayMs   int    `yaml:"request_delay_ms"`
+
+	// IntervalMinutes is how often this source is re-scraped; 0 falls back to
+	// donkeytownsfolk's default interval.
+	IntervalMinutes int `yaml:"interval_minutes"`
+
+	// RendererMode is "static" (default) or "headless" - see donkeytownsfolk.RendererMode.
+	// WaitSelector only applies in headless mode: the fetcher waits for it to appear
+	// before handing the rendered HTML off to the selectors above.
+	RendererMode string `yaml:"renderer_mode"`
+	WaitSelector string `yaml:"wait_selector"`
+}
+
+type sourcesFile struct {
+	Sources []SourceConfig `yaml:"sources"`
+}
+
+// LoadSources parses a sources.yaml file into its SourceConfig entries.
+func LoadSources(path string) ([]SourceConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("configscraper: couldn't read %s: %s", path, err.Error())
+	}
+
+	var f sourcesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("configscraper: couldn't parse %s: %s", path, err.Error())
+	}
+
+	return f.Sources, nil
+}
+
+// SetupRenderer loads sources.yaml from path and registers each entry as a
+// donkeytownsfolk.PriceSource. It's meant to be called once at startup, alongside
+// donkeytownsfolk.Init.
+func SetupRenderer(path string) error {
+	configs, err := LoadSources(path)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range configs {
+		donkeytownsfolk.RegisterPriceSource(newConfigSource(c))
+	}
+	return nil
+}
+
+// configSource is a donkeytownsfolk.PriceSource compiled from a SourceConfig. It
+// reuses the shared httpFetcher for retries/backoff/UA rotation just like the
+// built-in sources.
+type configSource struct {
+	cfg        SourceConfig
+	fetcher    donkeytownsfolk.Fetcher
+	nameRegex  *regexp.Regexp
+	priceRegex *regexp.Regexp
+}
+
+func newConfigSource(cfg SourceConfig) *configSource {
+	s := &configSource{cfg: cfg, fetcher: donkeytownsfolk.SharedFetcher()}
+	if cfg.NameRegex != "" {
+		s.nameRegex = regexp.MustCompile(cfg.NameRegex)
+	}
+	if cfg.PriceRegex != "" {
+		s.priceRegex = regexp.MustCompile(cfg.PriceRegex)
+	}
+	return s
+}
+
+func (s *configSource) Name() string { return s.cfg.Name }
+func (s *configSource) Domains() []string {
+	if u, err := url.Parse(s.cfg.BaseUrl); err == nil && u.Host != "" {
+		return []string{u.Host}
+	}
+	return []string{s.cfg.BaseUrl}
+}
+
+func (s *configSource) Interval() time.Duration {
+	if s.cfg.IntervalMinutes <= 0 {
+		return donkeytownsfolk.DefaultSourceInterval
+	}
+	return time.Duration(s.cfg.IntervalMinutes) * time.Minute
+}
+
+func (s *configSource) RendererMode() donkeytownsfolk.RendererMode {
+	if s.cfg.RendererMode == "headless" {
+		return donkeytownsfolk.ModeHeadless
+	}
+	return donkeytownsfolk.ModeStatic
+}
+
+func (s *configSource) fetchPage(ctx context.Context, url string) (*goquery.Document, error) {
+	if s.RendererMode() == donkeytownsfolk.ModeHeadless {
+		return s.fetcher.GetRendered(ctx, url, s.cfg.WaitSelector)
+	}
+	return s.fetcher.Get(ctx, url)
+}
+
+func (s *configSource) FetchAll(ctx context.Context) ([]*donkeytownsfolk.PriceDbEntry, error) {
+	index, err := s.fetchPage(ctx, s.cfg.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	pageUrls := []string{}
+	var resolveErr error
+	index.Find(s.cfg.IndexSelector).EachWithBreak(func(i int, sel *goquery.Selection) bool {
+		href, exists := sel.Attr("href")
+		if !exists {
+			return true
+		}
+		u, err := resolveUrl(s.cfg.BaseUrl, href)
+		if err != nil {
+			resolveErr = err
+			return false
+		}
+		pageUrls = append(pageUrls, u)
+		return true
+	})
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	if len(pageUrls) == 0 {
+		pageUrls = []string{s.cfg.BaseUrl}
+	}
+
+	entries := []*donkeytownsfolk.PriceDbEntry{}
+	for _, url := range pageUrls {
+		for url != "" {
+			if s.cfg.RequestDelayMs > 0 {
+				time.Sleep(time.Duration(s.cfg.RequestDelayMs) * time.Millisecond)
+			}
+
+			page, err := s.fetchPage(ctx, url)
+			if err != nil {
+				return nil, err
+			}
+
+			pageEntries, err := s.parsePage(page)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, pageEntries...)
+
+			url = ""
+			if s.cfg.NextPageSelector != "" {
+				if next, exists := page.Find(s.cfg.NextPageSelector).Attr("href"); exists {
+					url, err = resolveUrl(s.cfg.BaseUrl, next)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *configSource) parsePage(doc *goquery.Document) ([]*donkeytownsfolk.PriceDbEntry, error) {
+	entries := []*donkeytownsfolk.PriceDbEntry{}
+	var parseErr error
+
+	doc.Find(s.cfg.RowSelector).EachWithBreak(func(i int, row *goquery.Selection) bool {
+		name := strings.TrimSpace(row.Find(s.cfg.NameSelector).Text())
+		priceText := strings.TrimSpace(row.Find(s.cfg.PriceSelector).Text())
+
+		if s.nameRegex != nil {
+			if m := s.nameRegex.FindStringSubmatch(name); len(m) > 1 {
+				name = m[1]
+			}
+		}
+		if s.priceRegex != nil {
+			if m := s.priceRegex.FindStringSubmatch(priceText); len(m) > 1 {
+				priceText = m[1]
+			}
+		}
+		priceText = strings.TrimPrefix(priceText, "$")
+		priceText = strings.Replace(priceText, ",", "", -1)
+
+		if name == "" || priceText == "" {
+			return true
+		}
+
+		price, err := strconv.ParseFloat(priceText, 64)
+		if err != nil {
+			parseErr = fmt.Errorf("configscraper: source %q: couldn't parse price %q for %q: %s", s.cfg.Name, priceText, name, err.Error())
+			return false
+		}
+
+		entries = append(entries, donkeytownsfolk.NewPriceDbEntry(name, donkeytownsfolk.Money(price)))
+		return true
+	})
+
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return entries, nil
+}
+
+// schemeLen is how many bytes of base's leading scheme ("http://" or
+// "https://") to skip before looking for the start of its path, so that
+// scheme isn't mistaken for the first path segment's "/".
+func schemeLen(base string) int {
+	switch {
+	case strings.HasPrefix(base, "https://"):
+		return len("https://")
+	case strings.HasPrefix(base, "http://"):
+		return len("http://")
+	default:
+		return -1
+	}
+}
+
+// resolveUrl resolves href against base for a link found on a page served
+// from base: an absolute href is returned as-is, otherwise it's joined to
+// base's origin (scheme + host). A relative href without a leading "/" is
+// joined to that origin too, not to base's directory. base must be an
+// absolute http(s) URL, since that's the only shape a configured base_url
+// should ever have - anything else is an operator config error.
+func resolveUrl(base, href string) (string, error) {
+	if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") {
+		return href, nil
+	}
+
+	n := schemeLen(base)
+	if n < 0 {
+		return "", fmt.Errorf("configscraper: base_url %q is not an absolute http(s) URL", base)
+	}
+
+	origin := base
+	if idx := strings.Index(base[n:], "/"); idx >= 0 {
+		origin = base[:idx+n]
+	}
+	if !strings.HasPrefix(href, "/") {
+		return origin + "/" + href, nil
+	}
+	return origin + href, nil
+}
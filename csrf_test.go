@@ -0,0 +1,118 @@
+package donkeytownsfolk
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func newTestSessionStore() SessionStore {
+	return sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+}
+
+// attachSessionCookies copies the Set-Cookie headers a prior response wrote
+// onto a new request, simulating the browser carrying the session cookie
+// (and the CSRF token inside it) from one request to the next.
+func attachSessionCookies(r *http.Request, w *httptest.ResponseRecorder) {
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+}
+
+func newFormPost(body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/delete-deck", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestCheckCsrfTokenAllowsGet(t *testing.T) {
+	store := newTestSessionStore()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := checkCsrfToken(r, store); err != nil {
+		t.Fatalf("GET should never be rejected, got %v", err)
+	}
+}
+
+func TestCheckCsrfTokenAllowsMatchingFormToken(t *testing.T) {
+	store := newTestSessionStore()
+
+	w1 := httptest.NewRecorder()
+	tok, err := ensureCsrfToken(w1, httptest.NewRequest(http.MethodGet, "/", nil), store)
+	if err != nil {
+		t.Fatalf("ensureCsrfToken: %v", err)
+	}
+
+	r2 := newFormPost("csrf_token=" + tok)
+	attachSessionCookies(r2, w1)
+
+	if err := checkCsrfToken(r2, store); err != nil {
+		t.Fatalf("expected the session's own token to be allowed, got %v", err)
+	}
+}
+
+func TestCheckCsrfTokenAllowsMatchingHeaderToken(t *testing.T) {
+	store := newTestSessionStore()
+
+	w1 := httptest.NewRecorder()
+	tok, err := ensureCsrfToken(w1, httptest.NewRequest(http.MethodGet, "/", nil), store)
+	if err != nil {
+		t.Fatalf("ensureCsrfToken: %v", err)
+	}
+
+	r2 := newFormPost("")
+	r2.Header.Set("X-CSRF-Token", tok)
+	attachSessionCookies(r2, w1)
+
+	if err := checkCsrfToken(r2, store); err != nil {
+		t.Fatalf("expected the session's own token to be allowed via header, got %v", err)
+	}
+}
+
+func TestCheckCsrfTokenRejectsMissingToken(t *testing.T) {
+	store := newTestSessionStore()
+
+	w1 := httptest.NewRecorder()
+	if _, err := ensureCsrfToken(w1, httptest.NewRequest(http.MethodGet, "/", nil), store); err != nil {
+		t.Fatalf("ensureCsrfToken: %v", err)
+	}
+
+	r2 := newFormPost("")
+	attachSessionCookies(r2, w1)
+
+	if err := checkCsrfToken(r2, store); err != CsrfTokenMismatchError {
+		t.Fatalf("expected CsrfTokenMismatchError, got %v", err)
+	}
+}
+
+// TestCheckCsrfTokenRejectsCrossOriginToken simulates a form hosted on another
+// origin: the victim's session cookie is attached (browsers do this
+// automatically), but the attacker has no way to know the session's real
+// token, so it submits whatever it wants instead.
+func TestCheckCsrfTokenRejectsCrossOriginToken(t *testing.T) {
+	store := newTestSessionStore()
+
+	w1 := httptest.NewRecorder()
+	if _, err := ensureCsrfToken(w1, httptest.NewRequest(http.MethodGet, "/", nil), store); err != nil {
+		t.Fatalf("ensureCsrfToken: %v", err)
+	}
+
+	r2 := newFormPost("csrf_token=attacker-guessed-token")
+	attachSessionCookies(r2, w1)
+
+	if err := checkCsrfToken(r2, store); err != CsrfTokenMismatchError {
+		t.Fatalf("expected CsrfTokenMismatchError, got %v", err)
+	}
+}
+
+func TestCheckCsrfTokenRejectsMissingSession(t *testing.T) {
+	store := newTestSessionStore()
+
+	// no prior request ever established a session/token for this request
+	r := newFormPost("csrf_token=anything")
+	if err := checkCsrfToken(r, store); err != CsrfTokenMismatchError {
+		t.Fatalf("expected CsrfTokenMismatchError, got %v", err)
+	}
+}
@@ -22,10 +22,44 @@ type (
 	}
 
 	User struct {
-		Name         string  // username (must be unique)
-		PasswordHash []byte  // password as hashed using bcrypt
+		Name string // username (must be unique)
+
+		// NormalizedName is normalizeString(Name), persisted so FindUser can do a
+		// single indexed query instead of scanning every user doc in Go. Kept in
+		// sync by AddUser/UpdateUser; EnsureIndex'd as unique in OpenDbWithConfig.
+		NormalizedName string
+
+		// Email is the user's verified address, collected at signup and confirmed
+		// by whichever OAuth provider they link. It's how findOrCreateOAuthUser
+		// links a federated login to an existing password account instead of
+		// creating a duplicate - matching on Name would only work for accounts
+		// that were themselves created via OAuth. May be empty for old accounts
+		// that signed up before this field existed.
+		Email string
+
+		// NormalizedEmail is normalizeEmail(Email), persisted so FindUserByEmail
+		// can do a single indexed query the same way FindUser does on
+		// NormalizedName. Kept in sync by AddUser/UpdateUser; EnsureIndex'd as a
+		// sparse unique index in OpenDbWithConfig, so it's tagged omitempty -
+		// otherwise every account with no email would store "" and collide with
+		// every other one under a sparse index, which only skips absent fields.
+		NormalizedEmail string `bson:"normalizedemail,omitempty"`
+
+		PasswordHash []byte  // password as hashed using bcrypt (nil if the account was created via OAuth and never set one)
 		SessionKey   []byte  // the last session key that was handed out for this user
+		ApiToken     []byte  // bearer token for the /api/v1 surface, reissued via POST /api/v1/tokens
 		Decks        []*Deck // all of the user's decks
+
+		// Version is bumped on every UpdateUserFunc commit, and is the optimistic-
+		// concurrency check for that commit: it only succeeds if the document's
+		// version still matches what was loaded. Docs that predate this field
+		// read as zero, which is exactly the right starting point.
+		Version int
+
+		// OAuthIdentities maps provider name ("google", "github") to the verified email
+		// linked to this account for that provider, so a user can log in with any of
+		// several linked providers, or a password, interchangeably.
+		OAuthIdentities map[string]string
 	}
 
 	Deck struct {
@@ -34,6 +68,30 @@ type (
 		PriceLimit   Money
 		StagingArea  Snapshot
 		Snapshots    []*Snapshot
+
+		// GrandfatherLegal exempts the whole deck from PriceLimit, the same way an
+		// individual Snapshot.IsGrandfatherLegal exempts just that snapshot. It's
+		// normally set by materializing an expired PendingChange rather than
+		// directly, so a grandfather clause can be revoked on a schedule.
+		GrandfatherLegal bool
+
+		// PendingChanges are PriceLimit/GrandfatherLegal changes queued to take
+		// effect at a future date instead of immediately - see PendingChange and
+		// resolveEffectiveLimitAndGrandfather. sweepPendingChangesForever
+		// periodically materializes expired ones into PriceLimit/GrandfatherLegal
+		// above and removes them from this slice, but IsSnapshotLegal also
+		// resolves them on the fly so legality is never stale between sweeps.
+		PendingChanges []*PendingChange
+	}
+
+	// PendingChange schedules a PriceLimit or GrandfatherLegal change to land at
+	// EffectiveAt rather than immediately, for league-style rotations where
+	// limits tighten on a schedule announced in advance. Only one of
+	// NewPriceLimit/NewGrandfather needs to be set.
+	PendingChange struct {
+		EffectiveAt    time.Time
+		NewPriceLimit  *Money
+		NewGrandfather *bool
 	}
 
 	Snapshot struct {
@@ -49,6 +107,16 @@ type (
 		Count    int
 		PricePer Money
 		NotFound bool
+
+		// Source is the PriceSource that most recently priced this card, so decklist
+		// views can show where each price came from.
+		Source string
+
+		// PricePer30dAgo/PctChange are filled in by CalculatePrices from price_history,
+		// so decklist views can flag cards that have spiked recently. PctChange is left
+		// at zero if there's no history point old enough to compare against.
+		PricePer30dAgo Money
+		PctChange      float64
 	}
 
 	CommanderEntry struct {
@@ -56,12 +124,23 @@ type (
 		Price     Money
 		IsPresent bool
 		NotFound  bool
+		Source    string
 	}
 
 	PriceDbEntry struct {
-		ID    string // Lower case name without any non-alphanumeric characters
-		Name  string
-		Price Money
+		ID     string // Lower case name without any non-alphanumeric characters
+		Name   string
+		Price  Money
+		Source string // which PriceSource most recently priced this card, for price_history
+	}
+
+	// PricePoint is a single historical (price, source) reading for a card, recorded
+	// on every successful scrape so trends can be charted over time.
+	PricePoint struct {
+		CardID    string
+		Timestamp time.Time
+		Price     Money
+		Source    string
 	}
 
 	ScraperStats struct {
@@ -76,7 +155,20 @@ const (
 	MongoUsersCollectionName              = "users"
 	MongoPricesCollectionName             = "prices"
 	MongoScraperStatsCollectionName       = "scraperstats"
+	MongoSourceStatsCollectionName        = "sourcestats"
+	MongoSourcePricesCollectionName       = "sourceprices"
+	MongoPriceHistoryCollectionName       = "price_history"
 	Free                            Money = 0
+
+	// NoMoney is the "no price filter applied" sentinel used by
+	// getFilterResults/searchIndex.Search, distinct from Free (a real price
+	// limit of zero) so filtering by price zero and not filtering at all don't
+	// collide.
+	NoMoney Money = -1
+
+	// priceHistoryDailyRetention is how long we keep every recorded point before
+	// compacting down to weekly points, to bound storage growth.
+	priceHistoryDailyRetention = 90 * 24 * time.Hour
 )
 
 var (
@@ -120,16 +212,54 @@ func ParseCardEntryLines(s string) []*CardEntry {
 	return entries
 }
 
+// OpenDb connects using DefaultConfig(). Most callers that don't need a
+// custom connection URI, pool size, or TLS setup should use this.
 func OpenDb() (*Db, error) {
-	db, err := mgo.Dial(MongoServerAddress)
+	return OpenDbWithConfig(DefaultConfig())
+}
+
+func OpenDbWithConfig(cfg *Config) (*Db, error) {
+	info, err := mgo.ParseURL(cfg.URI)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.PoolLimit > 0 {
+		info.PoolLimit = cfg.PoolLimit
+	}
+	if cfg.SocketTimeout > 0 {
+		info.Timeout = cfg.SocketTimeout
+	}
 
-	c := db.DB(MongoDbName).C(MongoPricesCollectionName)
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	c := session.DB(MongoDbName).C(MongoPricesCollectionName)
 	c.EnsureIndexKey("id")
 
-	return &Db{db}, nil
+	history := session.DB(MongoDbName).C(MongoPriceHistoryCollectionName)
+	if err := history.EnsureIndexKey("cardid", "timestamp"); err != nil {
+		return nil, err
+	}
+
+	if err := migrateNormalizedNames(session); err != nil {
+		return nil, err
+	}
+
+	users := session.DB(MongoDbName).C(MongoUsersCollectionName)
+	if err := users.EnsureIndex(mgo.Index{Key: []string{"normalizedname"}, Unique: true}); err != nil {
+		return nil, err
+	}
+	if err := users.EnsureIndex(mgo.Index{Key: []string{"normalizedemail"}, Unique: true, Sparse: true}); err != nil {
+		return nil, err
+	}
+
+	ret := &Db{session}
+	if err := RebuildSearchIndex(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 func (db *Db) GetScraperStats() (*ScraperStats, error) {
@@ -150,8 +280,70 @@ func (db *Db) SetScraperStats(s *ScraperStats) error {
 	return c.Insert(s)
 }
 
-func (user *User) NormalizedName() string {
-	return normalizeString(user.Name)
+// sourceStatsDoc is the on-disk shape for a single PriceSource's SourceStats, since
+// mgo can't round-trip a bare map[string]*SourceStats as a top-level document.
+type sourceStatsDoc struct {
+	Name  string
+	Stats SourceStats
+}
+
+func (db *Db) GetSourceStats() (map[string]*SourceStats, error) {
+	c := db.db.DB(MongoDbName).C(MongoSourceStatsCollectionName)
+	docs := []sourceStatsDoc{}
+	if err := c.Find(nil).All(&docs); err != nil {
+		return nil, err
+	}
+
+	ret := map[string]*SourceStats{}
+	for _, d := range docs {
+		stats := d.Stats
+		ret[d.Name] = &stats
+	}
+	return ret, nil
+}
+
+func (db *Db) SetSourceStats(stats map[string]*SourceStats) error {
+	c := db.db.DB(MongoDbName).C(MongoSourceStatsCollectionName)
+	for name, s := range stats {
+		_, err := c.Upsert(bson.M{"name": name}, sourceStatsDoc{name, *s})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourcePricesDoc is the on-disk shape of a single PriceSource's most recent full
+// FetchAll result, keyed by source name so recomputeAndPersistMergedPrices can
+// rebuild the per-card min from every source's latest snapshot instead of merging
+// against whatever previously won.
+type sourcePricesDoc struct {
+	Name    string
+	Entries []*PriceDbEntry
+}
+
+// SetSourcePrices replaces source's stored snapshot of the last full FetchAll it
+// returned.
+func (db *Db) SetSourcePrices(source string, entries []*PriceDbEntry) error {
+	c := db.db.DB(MongoDbName).C(MongoSourcePricesCollectionName)
+	_, err := c.Upsert(bson.M{"name": source}, sourcePricesDoc{source, entries})
+	return err
+}
+
+// GetAllSourcePrices returns every registered source's most recent full FetchAll
+// snapshot, keyed by source name.
+func (db *Db) GetAllSourcePrices() (map[string][]*PriceDbEntry, error) {
+	c := db.db.DB(MongoDbName).C(MongoSourcePricesCollectionName)
+	docs := []sourcePricesDoc{}
+	if err := c.Find(nil).All(&docs); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]*PriceDbEntry, len(docs))
+	for _, d := range docs {
+		ret[d.Name] = d.Entries
+	}
+	return ret, nil
 }
 
 func (user *User) FindDeck(name string) *Deck {
@@ -222,6 +414,33 @@ func (d *Deck) IsGrandfatherLegal() bool {
 	return s != nil && s.IsGrandfatherLegal
 }
 
+// resolveEffectiveLimitAndGrandfather returns the deck's effective PriceLimit
+// and GrandfatherLegal, applying any PendingChanges whose EffectiveAt is at or
+// before now that sweepPendingChangesForever hasn't materialized yet. For each
+// field independently, the PendingChange with the latest EffectiveAt <= now
+// wins, regardless of queue order.
+func (d *Deck) resolveEffectiveLimitAndGrandfather(now time.Time) (Money, bool) {
+	limit := d.PriceLimit
+	grandfather := d.GrandfatherLegal
+	var limitAt, grandfatherAt time.Time
+
+	for _, p := range d.PendingChanges {
+		if p.EffectiveAt.After(now) {
+			continue
+		}
+		if p.NewPriceLimit != nil && p.EffectiveAt.After(limitAt) {
+			limit = *p.NewPriceLimit
+			limitAt = p.EffectiveAt
+		}
+		if p.NewGrandfather != nil && p.EffectiveAt.After(grandfatherAt) {
+			grandfather = *p.NewGrandfather
+			grandfatherAt = p.EffectiveAt
+		}
+	}
+
+	return limit, grandfather
+}
+
 func (d *Deck) IsSnapshotLegal(s *Snapshot) bool {
 	if s.Commander.IsPresent && s.Commander.NotFound {
 		return false
@@ -237,7 +456,8 @@ func (d *Deck) IsSnapshotLegal(s *Snapshot) bool {
 		}
 	}
 
-	return s != nil && (s.IsGrandfatherLegal || (s.TotalPrice() <= d.PriceLimit))
+	limit, grandfather := d.resolveEffectiveLimitAndGrandfather(time.Now())
+	return s != nil && (s.IsGrandfatherLegal || grandfather || (s.TotalPrice() <= limit))
 }
 
 func (d *Deck) IsLegal() bool {
@@ -248,29 +468,122 @@ func (d *Deck) IsStagingAreaLegal() bool {
 	return d.IsSnapshotLegal(&d.StagingArea)
 }
 
-func (db *Db) NameAndPrice(id string) (string, Money, error) {
+func (db *Db) NameAndPrice(id string) (string, Money, string, error) {
 	c := db.db.DB(MongoDbName).C(MongoPricesCollectionName)
 	e := PriceDbEntry{}
 	err := c.Find(bson.M{"id": id}).One(&e)
 	if err != nil {
-		return "", Free, err
+		return "", Free, "", err
 	}
-	return e.Name, e.Price, nil
+	return e.Name, e.Price, e.Source, nil
 }
 
+// UpdateAllPrices replaces the prices collection with prices, upserting each card
+// by ID and removing anything no longer present, so a concurrent NameAndPrice read
+// never observes the collection empty (as a RemoveAll-then-Insert would allow).
 func (db *Db) UpdateAllPrices(prices []*PriceDbEntry) error {
-	ins := make([]interface{}, len(prices))
-	for i := 0; i < len(prices); i++ {
-		ins[i] = prices[i]
+	c := db.db.DB(MongoDbName).C(MongoPricesCollectionName)
+
+	keep := make([]string, len(prices))
+	bulk := c.Bulk()
+	for i, p := range prices {
+		keep[i] = p.ID
+		bulk.Upsert(bson.M{"id": p.ID}, p)
+	}
+	if len(prices) > 0 {
+		if _, err := bulk.Run(); err != nil {
+			return err
+		}
 	}
 
-	c := db.db.DB(MongoDbName).C(MongoPricesCollectionName)
-	if _, err := c.RemoveAll(nil); err != nil {
-		return err
+	_, err := c.RemoveAll(bson.M{"id": bson.M{"$nin": keep}})
+	return err
+}
+
+// AppendPriceHistory records one PricePoint per entry at the current time, so that
+// Db.PriceHistory can later chart how a card's price has moved.
+func (db *Db) AppendPriceHistory(entries []*PriceDbEntry) error {
+	if len(entries) == 0 {
+		return nil
 	}
+
+	now := time.Now()
+	ins := make([]interface{}, len(entries))
+	for i, e := range entries {
+		ins[i] = PricePoint{CardID: e.ID, Timestamp: now, Price: e.Price, Source: e.Source}
+	}
+
+	c := db.db.DB(MongoDbName).C(MongoPriceHistoryCollectionName)
 	return c.Insert(ins...)
 }
 
+// PriceHistory returns every recorded PricePoint for cardId since the given time,
+// oldest first.
+func (db *Db) PriceHistory(cardId string, since time.Time) ([]PricePoint, error) {
+	c := db.db.DB(MongoDbName).C(MongoPriceHistoryCollectionName)
+	points := []PricePoint{}
+	err := c.Find(bson.M{"cardid": cardId, "timestamp": bson.M{"$gte": since}}).Sort("timestamp").All(&points)
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// pricesAtOrBefore returns the most recent PricePoint at or before t for every
+// card in cardIds, in a single query against the {cardid, timestamp} index, so a
+// deck/snapshot render with N cards costs one scan instead of N.
+func (db *Db) pricesAtOrBefore(cardIds []string, t time.Time) (map[string]*PricePoint, error) {
+	if len(cardIds) == 0 {
+		return map[string]*PricePoint{}, nil
+	}
+
+	c := db.db.DB(MongoDbName).C(MongoPriceHistoryCollectionName)
+	points := []PricePoint{}
+	err := c.Find(bson.M{"cardid": bson.M{"$in": cardIds}, "timestamp": bson.M{"$lte": t}}).
+		Sort("cardid", "-timestamp").All(&points)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]*PricePoint, len(cardIds))
+	for i := range points {
+		p := &points[i]
+		if _, ok := ret[p.CardID]; !ok {
+			ret[p.CardID] = p
+		}
+	}
+	return ret, nil
+}
+
+// CompactPriceHistory thins out old price_history points so storage doesn't grow
+// without bound: points older than priceHistoryDailyRetention are reduced to one
+// per calendar week (the earliest point seen in the retained set for that card and
+// week), leaving every point of recent history in place.
+func (db *Db) CompactPriceHistory() error {
+	c := db.db.DB(MongoDbName).C(MongoPriceHistoryCollectionName)
+
+	cutoff := time.Now().Add(-priceHistoryDailyRetention)
+	old := []PricePoint{}
+	if err := c.Find(bson.M{"timestamp": bson.M{"$lt": cutoff}}).Sort("timestamp").All(&old); err != nil {
+		return err
+	}
+
+	kept := map[string]bool{} // cardID + iso-year-week -> already kept a point
+	for _, p := range old {
+		year, week := p.Timestamp.ISOWeek()
+		key := fmt.Sprintf("%s|%d-%02d", p.CardID, year, week)
+		if kept[key] {
+			if err := c.Remove(bson.M{"cardid": p.CardID, "timestamp": p.Timestamp}); err != nil {
+				return err
+			}
+		} else {
+			kept[key] = true
+		}
+	}
+
+	return nil
+}
+
 func (db *Db) AllUsers() ([]*User, error) {
 	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
 	users := []*User{}
@@ -283,10 +596,49 @@ func (db *Db) AllUsers() ([]*User, error) {
 func (db *Db) FindUser(name string) (*User, error) {
 	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
 
+	user := User{}
+	err := c.Find(bson.M{"normalizedname": normalizeString(name)}).One(&user)
+	if err == mgo.ErrNotFound {
+		return nil, UserNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// FindUserByEmail looks up the user whose Email matches email, case-insensitively.
+// Used to link a newly-verified OAuth identity to an existing password account
+// instead of matching (incorrectly) on username.
+func (db *Db) FindUserByEmail(email string) (*User, error) {
+	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
+
+	user := User{}
+	err := c.Find(bson.M{"normalizedemail": normalizeEmail(email)}).One(&user)
+	if err == mgo.ErrNotFound {
+		return nil, UserNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// FindUserByApiToken looks up the user whose current ApiToken matches token, for
+// authenticating requests against the /api/v1 surface.
+func (db *Db) FindUserByApiToken(token []byte) (*User, error) {
+	if len(token) == 0 {
+		return nil, UserNotFoundError
+	}
+
+	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
+
 	user := User{}
 	iter := c.Find(nil).Iter()
 	for iter.Next(&user) {
-		if normalizeString(name) == user.NormalizedName() {
+		if bytes.Equal(user.ApiToken, token) {
 			return &user, nil
 		}
 	}
@@ -298,25 +650,149 @@ func (db *Db) FindUser(name string) (*User, error) {
 	return nil, UserNotFoundError
 }
 
-func (db *Db) AddUser(name string, passwordHash []byte) (*User, error) {
-	if _, err := db.FindUser(name); err != UserNotFoundError {
-		return nil, UserAlreadyExistsError
-	}
-
+func (db *Db) AddUser(name string, email string, passwordHash []byte) (*User, error) {
 	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
-	user := User{name, passwordHash, []byte{}, []*Deck{}}
-	c.Insert(user)
+	user := User{
+		Name:            name,
+		NormalizedName:  normalizeString(name),
+		Email:           email,
+		NormalizedEmail: normalizeEmail(email),
+		PasswordHash:    passwordHash,
+		SessionKey:      []byte{},
+		ApiToken:        []byte{},
+		Decks:           []*Deck{},
+		OAuthIdentities: map[string]string{},
+	}
+	if err := c.Insert(user); err != nil {
+		if mgo.IsDup(err) {
+			return nil, UserAlreadyExistsError
+		}
+		return nil, err
+	}
+	globalSearchIndex.SyncUser(&user)
 	return &user, nil
 }
 
 func (db *Db) DeleteUser(user *User) error {
 	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
-	return c.Remove(bson.M{"name": user.Name})
+	if err := c.Remove(bson.M{"name": user.Name}); err != nil {
+		return err
+	}
+	globalSearchIndex.RemoveUser(user)
+	return nil
 }
 
 func (db *Db) UpdateUser(user *User) error {
+	user.NormalizedName = normalizeString(user.Name)
+	user.NormalizedEmail = normalizeEmail(user.Email)
+
 	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
-	return c.Update(bson.M{"name": user.Name}, user)
+	if err := c.Update(bson.M{"name": user.Name}, user); err != nil {
+		return err
+	}
+	globalSearchIndex.SyncUser(user)
+	return nil
+}
+
+// maxUpdateUserFuncAttempts bounds how many times UpdateUserFunc will reload
+// and retry fn after losing the optimistic-concurrency race, before giving up.
+const maxUpdateUserFuncAttempts = 5
+
+// UpdateUserFunc loads the user named name, invokes fn on it, and commits the
+// result with an optimistic-concurrency check against Version - the write only
+// lands if no other commit has happened in between. On a lost race it reloads
+// the latest doc and retries fn from scratch, up to maxUpdateUserFuncAttempts
+// times, so two concurrent requests that mutate different decks on the same
+// user no longer silently clobber each other the way a plain UpdateUser would.
+//
+// fn should only read/modify the *User it's given; it must not retain or
+// mutate any of its own captured state across calls, since it may run more
+// than once per UpdateUserFunc call.
+func (db *Db) UpdateUserFunc(name string, fn func(*User) error) (*User, error) {
+	c := db.db.DB(MongoDbName).C(MongoUsersCollectionName)
+
+	var lastErr error
+	for attempt := 0; attempt < maxUpdateUserFuncAttempts; attempt++ {
+		user := User{}
+		err := c.Find(bson.M{"normalizedname": normalizeString(name)}).One(&user)
+		if err == mgo.ErrNotFound {
+			return nil, UserNotFoundError
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		version := user.Version
+		if err := fn(&user); err != nil {
+			return nil, err
+		}
+		user.NormalizedName = normalizeString(user.Name)
+		user.NormalizedEmail = normalizeEmail(user.Email)
+
+		raw, err := bson.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		fields := bson.M{}
+		if err := bson.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		delete(fields, "version")
+
+		update := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+		selector := bson.M{"name": user.Name, "version": version}
+		if version == 0 {
+			// docs that predate Version have no version field at all, which
+			// {"version": 0} wouldn't match
+			selector["version"] = bson.M{"$in": []interface{}{0, nil}}
+		}
+		err = c.Update(selector, update)
+		if err == mgo.ErrNotFound {
+			lastErr = fmt.Errorf("UpdateUserFunc: lost optimistic-concurrency race on %q (attempt %d)", name, attempt+1)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		user.Version = version + 1
+		globalSearchIndex.SyncUser(&user)
+		return &user, nil
+	}
+
+	return nil, lastErr
+}
+
+// migrateNormalizedNames backfills the NormalizedName field on any user doc
+// that predates it (or that was somehow inserted without one), so the unique
+// index EnsureIndex'd right after this runs doesn't reject pre-existing docs
+// that would otherwise all collide on the empty string. Safe to run on every
+// startup: once every doc has its field set, the query matches nothing and
+// this is a single cheap round trip.
+func migrateNormalizedNames(session *mgo.Session) error {
+	c := session.DB(MongoDbName).C(MongoUsersCollectionName)
+
+	stale := []*User{}
+	query := bson.M{"$or": []bson.M{
+		{"normalizedname": bson.M{"$exists": false}},
+		{"normalizedname": ""},
+	}}
+	if err := c.Find(query).All(&stale); err != nil {
+		return err
+	}
+
+	for _, user := range stale {
+		normalized := normalizeString(user.Name)
+		if normalized == "" {
+			continue
+		}
+		err := c.Update(bson.M{"name": user.Name}, bson.M{"$set": bson.M{"normalizedname": normalized}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (m Money) String() string {
@@ -437,6 +913,14 @@ func normalizeRune(r rune) rune {
 	}
 }
 
+// normalizeEmail lowercases and trims s for case-insensitive email matching.
+// Unlike normalizeString, it leaves punctuation (".", "@") alone - those are
+// structural in an email address, not decoration to fold away like they are
+// in a username.
+func normalizeEmail(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
 // --- auxillary types/functions for sorting ---
 
 type decks []*Deck
@@ -0,0 +1,138 @@
+package donkeytownsfolk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/garbotron/donkeytownsfolk/deckformat"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// setupDeckExportRoutes wires up /deck/{user}/{deck}/export.{fmt} and the matching
+// import POST, letting a deck round-trip through the same formats other Magic
+// software uses (Arena, MTGO, plain text) instead of only donkeytownsfolk's own
+// flat "N Name" textarea format. See the deckformat package for the formats
+// themselves.
+func setupDeckExportRoutes(db *Db, s *mux.Router, store SessionStore) {
+	s.HandleFunc("/deck/{user}/{deck}/export.{fmt}", createHandler(db, store, performExportDecklist))
+	s.HandleFunc("/deck/{user}/{deck}/import", createHandler(db, store, performImportDecklist))
+}
+
+// snapshotToDecklist converts a Snapshot's cards into the format-agnostic shape
+// deckformat.Format operates on. It's the inverse of decklistLines/the commander
+// name passed to updateDecklistService.
+func snapshotToDecklist(snap *Snapshot) *deckformat.Decklist {
+	list := &deckformat.Decklist{}
+	if snap.Commander.IsPresent {
+		list.Commander = snap.Commander.Name
+	}
+	for _, c := range snap.Decklist {
+		list.Deck = append(list.Deck, deckformat.CardLine{Count: c.Count, Name: c.Name})
+	}
+	for _, c := range snap.Sideboard {
+		list.Sideboard = append(list.Sideboard, deckformat.CardLine{Count: c.Count, Name: c.Name})
+	}
+	return list
+}
+
+// decklistLines renders cards the way ParseCardEntryLines expects to read them
+// back: one "N Name" per line, joined with "\r\n".
+func decklistLines(cards []deckformat.CardLine) string {
+	lines := make([]string, len(cards))
+	for i, c := range cards {
+		lines[i] = fmt.Sprintf("%d %s", c.Count, c.Name)
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// performExportDecklist serves a deck's current staging area in the format named
+// by the "fmt" path segment (e.g. "export.mtga", "export.mtgo", "export.txt").
+// It's public, like renderDeckPage - exporting a deck doesn't require owning it.
+func performExportDecklist(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
+	vars := mux.Vars(r)
+
+	f, ok := deckformat.ByName(vars["fmt"])
+	if !ok {
+		return errors.New("Unknown export format '" + vars["fmt"] + "'")
+	}
+
+	u, err := db.FindUser(vars["user"])
+	if err != nil {
+		return err
+	}
+
+	d := u.FindDeck(vars["deck"])
+	if d == nil {
+		return errors.New("Deck '" + vars["deck"] + "' doesn't exist!")
+	}
+
+	w.Header().Set("Content-Type", f.MediaType())
+	w.Header().Set("Content-Disposition", `attachment; filename="`+d.NormalizedName()+"."+vars["fmt"]+`"`)
+	return f.Write(w, snapshotToDecklist(&d.StagingArea))
+}
+
+// performImportDecklist replaces a deck's staging area with a decklist uploaded
+// as the "decklist" file field. If the "format" field is set, that format is
+// used; otherwise the upload is content-sniffed. The caller must be logged in as
+// the deck's owner, same as performUpdateDecklist.
+func performImportDecklist(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
+	vars := mux.Vars(r)
+
+	user, err := findLoggedInUser(w, r, db, store)
+	if err != nil {
+		return err
+	}
+	if normalizeString(vars["user"]) != user.NormalizedName {
+		return errors.New("Can't import a decklist into another user's deck")
+	}
+
+	deck := user.FindDeck(vars["deck"])
+	if deck == nil {
+		return errors.New("Deck '" + vars["deck"] + "' doesn't exist!")
+	}
+
+	file, _, err := r.FormFile("decklist")
+	if err != nil {
+		return errors.New("Decklist file not included")
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	f := deckformat.Sniff(data)
+	if name := r.FormValue("format"); name != "" {
+		var ok bool
+		f, ok = deckformat.ByName(name)
+		if !ok {
+			return errors.New("Unknown import format '" + name + "'")
+		}
+	}
+
+	list, err := f.Parse(bytes.NewReader(data))
+	if err != nil {
+		return errors.New("Couldn't parse decklist: " + err.Error())
+	}
+
+	deckUrl := "/deck?user=" + user.NormalizedName + "&name=" + deck.NormalizedName()
+	grandfather := r.FormValue("grandfather") != ""
+
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d := u.FindDeck(vars["deck"])
+		if d == nil {
+			return errors.New("Deck '" + vars["deck"] + "' doesn't exist!")
+		}
+		return updateDecklistService(db, d, list.Commander, decklistLines(list.Deck), decklistLines(list.Sideboard), grandfather)
+	})
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, deckUrl, http.StatusFound)
+	return nil
+}
@@ -0,0 +1,93 @@
+// Package deckformat converts decklists to and from the text/XML formats other
+// Magic software uses (Arena's export, MTGO's .dek, plain text, and a
+// commander-aware plain-text variant), so donkeytownsfolk doesn't lock users
+// into its own flat "N Name" textarea format for getting a list in or out.
+//
+// Deliberately, Decklist here is not donkeytownsfolk.Snapshot: a Format only
+// ever needs cards in and cards out, not a database session, price data, or
+// legality tracking, and keeping the dependency one-directional (this package
+// knows nothing about donkeytownsfolk) avoids an import cycle with the HTTP
+// handlers that register these formats. Callers translate to/from Snapshot
+// themselves - see snapshotToDecklist/decklistLines in deckexport.go.
+package deckformat
+
+import (
+	"fmt"
+	"io"
+)
+
+// CardLine is one entry in a Decklist: a card name and how many copies.
+type CardLine struct {
+	Count int
+	Name  string
+}
+
+// Decklist is the format-agnostic shape every Format parses into and writes
+// from. Commander is empty when the list has none.
+type Decklist struct {
+	Commander string
+	Deck      []CardLine
+	Sideboard []CardLine
+}
+
+// Format converts a Decklist to and from one external representation.
+type Format interface {
+	// Parse reads a decklist in this format.
+	Parse(r io.Reader) (*Decklist, error)
+
+	// Write renders list in this format.
+	Write(w io.Writer, list *Decklist) error
+
+	// MediaType is the Content-Type an export is served with, and the type an
+	// import is expected to declare.
+	MediaType() string
+}
+
+var registry = map[string]Format{}
+var sniffOrder = []string{}
+
+// Register adds f under name, which is both the {fmt} extension used by the
+// HTTP export endpoint (".../export.mtga") and the key used by ByName. It
+// also participates in Sniff, in the order Register was called - so callers
+// should register more specific formats (ones that need a particular header
+// or tag to match) before more permissive fallbacks.
+func Register(name string, f Format) {
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("deckformat: %q already registered", name))
+	}
+	registry[name] = f
+	sniffOrder = append(sniffOrder, name)
+}
+
+// ByName looks up a registered Format by its export extension / import
+// "format" hint (e.g. "mtga", "mtgo", "txt", "edh").
+func ByName(name string) (Format, bool) {
+	f, ok := registry[name]
+	return f, ok
+}
+
+// Sniffer is implemented by formats that can tell, from the raw bytes alone,
+// whether an uploaded file is theirs. Sniff uses it to pick a Format for an
+// import POST that doesn't declare which format it's sending.
+type Sniffer interface {
+	Sniff(data []byte) bool
+}
+
+// Sniff returns the first registered format (in Register order) whose Sniff
+// matches data, or the "txt" format if none do - a file with no recognizable
+// structure is still a plausible flat card list.
+func Sniff(data []byte) Format {
+	for _, name := range sniffOrder {
+		if s, ok := registry[name].(Sniffer); ok && s.Sniff(data) {
+			return registry[name]
+		}
+	}
+	return registry["txt"]
+}
+
+func init() {
+	Register("mtgo", mtgoFormat{})
+	Register("mtga", mtgaFormat{})
+	Register("edh", edhFormat{})
+	Register("txt", txtFormat{})
+}
@@ -0,0 +1,78 @@
+package deckformat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// mtgoDeck is the root element of an MTGO .dek file: a flat list of <Cards>
+// elements, each one copy-per-line (a playset of 4 is four separate elements,
+// not one with Quantity="4" - MTGO writes it that way, though it reads either).
+type mtgoDeck struct {
+	XMLName xml.Name   `xml:"Deck"`
+	Cards   []mtgoCard `xml:"Cards"`
+}
+
+type mtgoCard struct {
+	Quantity   int    `xml:"Quantity,attr"`
+	Sideboard  bool   `xml:"Sideboard,attr"`
+	Name       string `xml:"Name,attr"`
+	Annotation int    `xml:"Annotation,attr"`
+}
+
+// mtgoFormat is MTGO's .dek XML export. MTGO has no separate commander
+// concept, so Decklist.Commander round-trips as an ordinary non-sideboard
+// card rather than being lost - there's nowhere else to put it.
+type mtgoFormat struct{}
+
+func (mtgoFormat) MediaType() string { return "application/xml" }
+
+func (mtgoFormat) Parse(r io.Reader) (*Decklist, error) {
+	var deck mtgoDeck
+	if err := xml.NewDecoder(r).Decode(&deck); err != nil {
+		return nil, err
+	}
+
+	list := &Decklist{}
+	for _, c := range deck.Cards {
+		qty := c.Quantity
+		if qty <= 0 {
+			qty = 1
+		}
+		line := CardLine{Count: qty, Name: c.Name}
+		if c.Sideboard {
+			list.Sideboard = append(list.Sideboard, line)
+		} else {
+			list.Deck = append(list.Deck, line)
+		}
+	}
+	return list, nil
+}
+
+func (mtgoFormat) Write(w io.Writer, list *Decklist) error {
+	deck := mtgoDeck{}
+	if list.Commander != "" {
+		deck.Cards = append(deck.Cards, mtgoCard{Quantity: 1, Name: list.Commander})
+	}
+	for _, c := range list.Deck {
+		deck.Cards = append(deck.Cards, mtgoCard{Quantity: c.Count, Name: c.Name})
+	}
+	for _, c := range list.Sideboard {
+		deck.Cards = append(deck.Cards, mtgoCard{Quantity: c.Count, Sideboard: true, Name: c.Name})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(deck)
+}
+
+// Sniff recognizes an MTGO .dek file by its XML declaration or root element,
+// since an uploaded import POST won't always set a Content-Type we can trust.
+func (mtgoFormat) Sniff(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("<Deck"))
+}
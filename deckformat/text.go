@@ -0,0 +1,245 @@
+package deckformat
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cardLineRegex pulls an optional leading count (with an optional x/X
+// multiplier) off the front of a card line, leaving the name - e.g. "3x Sol
+// Ring", "3 Sol Ring", and "Sol Ring" (implicit count of 1) all match.
+var cardLineRegex = regexp.MustCompile(`^(?:(\d+)\s*[xX]?\s+)?(.+)$`)
+
+// setCodeRegex strips a trailing set code and/or collector number, as Arena
+// exports them - "Lightning Bolt (M10) 146" or "Lightning Bolt (M10)".
+var setCodeRegex = regexp.MustCompile(`\s+\([A-Za-z0-9]{2,5}\)(?:\s+[A-Za-z0-9-]+)?\s*$`)
+
+// sectionHeaders are the block-introducing lines the text formats recognize,
+// keyed by lowercase text. "about" exists only to be skipped - Arena and some
+// other exporters prepend a metadata block before "Deck".
+var sectionHeaders = map[string]bool{
+	"deck": true, "commander": true, "sideboard": true, "about": true,
+}
+
+// parseCardLine parses a single decklist line, tolerating the conventions
+// real exporters use: a leading bullet, an "x"/"X" multiplier, and (if
+// stripSetCode) a trailing set code/collector number. Whole-line comments
+// ("//..." or "#...") and blank lines return ok=false. Note "//" is only
+// treated as a comment when it starts the (trimmed) line, not when it
+// appears mid-name, so split cards like "Fire // Ice" parse correctly.
+func parseCardLine(line string, stripSetCode bool) (CardLine, bool) {
+	line = strings.TrimSpace(line)
+	line = strings.TrimLeft(line, "-*•\t ")
+	line = strings.TrimSpace(line)
+
+	if line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") {
+		return CardLine{}, false
+	}
+
+	m := cardLineRegex.FindStringSubmatch(line)
+	if m == nil {
+		return CardLine{}, false
+	}
+
+	count, err := strconv.Atoi(m[1])
+	if err != nil || count <= 0 {
+		count = 1
+	}
+
+	name := strings.TrimSpace(m[2])
+	if stripSetCode {
+		name = strings.TrimSpace(setCodeRegex.ReplaceAllString(name, ""))
+	}
+	if name == "" {
+		return CardLine{}, false
+	}
+
+	return CardLine{Count: count, Name: name}, true
+}
+
+// parseSectioned splits r into blank-line-separated blocks and assigns each
+// to a section. A block whose first line is a recognized header (Deck,
+// Commander - if allowCommander, Sideboard, About) is consumed by that
+// section; an unheaded block is "deck" if no earlier unheaded block actually
+// produced a card, otherwise "sideboard" - this is what lets a bare two-block
+// file (no headers at all) still round-trip as decklist+sideboard, the way
+// plain-text exports usually look. A block's fate isn't decided until its
+// first real card line, not at the block boundary, so an unheaded block that
+// turns out to be pure comments (a "//"-prefixed export preamble, say) isn't
+// mistaken for the decklist, bumping the real one down to "sideboard". If
+// !allowCommander, a literal "Commander" line is just another unheaded block
+// rather than a recognized header.
+func parseSectioned(r io.Reader, stripSetCode bool, allowCommander bool) (*Decklist, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	list := &Decklist{}
+	section := ""
+	haveUnheadedBlock := false
+	pendingUnheadedBlock := false
+
+	flushLine := func(line string) {
+		card, ok := parseCardLine(line, stripSetCode)
+		if !ok {
+			return
+		}
+
+		if pendingUnheadedBlock {
+			if haveUnheadedBlock {
+				section = "sideboard"
+			} else {
+				section = "deck"
+				haveUnheadedBlock = true
+			}
+			pendingUnheadedBlock = false
+		}
+
+		switch section {
+		case "about":
+			// metadata block (deck name, etc.) - not cards, so drop it
+			return
+		case "commander":
+			list.Commander = card.Name
+		case "sideboard":
+			list.Sideboard = append(list.Sideboard, card)
+		default:
+			list.Deck = append(list.Deck, card)
+		}
+	}
+
+	blockStart := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == "" {
+			blockStart = true
+			continue
+		}
+
+		if blockStart {
+			blockStart = false
+			header := strings.ToLower(trimmed)
+			if sectionHeaders[header] && (allowCommander || header != "commander") {
+				section = header
+				pendingUnheadedBlock = false
+				continue
+			}
+			// unheaded block: its section isn't decided here - see flushLine -
+			// since a block that never yields a card shouldn't count as "the"
+			// decklist block and push the next one down to sideboard.
+			pendingUnheadedBlock = true
+		}
+
+		flushLine(line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// writeSectioned renders list with a header line per non-empty section,
+// separated by a blank line, in Commander/Deck/Sideboard order. If
+// !allowCommander, list.Commander is dropped rather than written, since a
+// format that can't parse a Commander header back out shouldn't write one.
+func writeSectioned(w io.Writer, list *Decklist, allowCommander bool) error {
+	wrote := false
+	writeBlock := func(header string, cards []CardLine) error {
+		if len(cards) == 0 {
+			return nil
+		}
+		if wrote {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if header != "" {
+			if _, err := io.WriteString(w, header+"\n"); err != nil {
+				return err
+			}
+		}
+		for _, c := range cards {
+			if _, err := io.WriteString(w, strconv.Itoa(c.Count)+" "+c.Name+"\n"); err != nil {
+				return err
+			}
+		}
+		wrote = true
+		return nil
+	}
+
+	if allowCommander && list.Commander != "" {
+		if err := writeBlock("Commander", []CardLine{{Count: 1, Name: list.Commander}}); err != nil {
+			return err
+		}
+	}
+	if err := writeBlock("Deck", list.Deck); err != nil {
+		return err
+	}
+	return writeBlock("Sideboard", list.Sideboard)
+}
+
+// mtgaFormat is Arena's plain-text export: blank-line-separated Commander
+// (Brawl/Historic Brawl only)/Deck/Sideboard sections, with set code and
+// collector number suffixes like "(NEO) 123".
+type mtgaFormat struct{}
+
+func (mtgaFormat) MediaType() string { return "text/plain; format=mtga" }
+
+func (mtgaFormat) Parse(r io.Reader) (*Decklist, error) {
+	return parseSectioned(r, true, true)
+}
+
+func (mtgaFormat) Write(w io.Writer, list *Decklist) error {
+	return writeSectioned(w, list, true)
+}
+
+func (mtgaFormat) Sniff(data []byte) bool {
+	return setCodeRegex.Match(data)
+}
+
+// edhFormat is a Commander-focused plain-text variant: the same sectioned
+// layout as mtgaFormat, but without Arena's set-code suffixes, for sites
+// (Moxfield, Archidekt, ...) that export a plain "Commander" header followed
+// by the deck and sideboard.
+type edhFormat struct{}
+
+func (edhFormat) MediaType() string { return "text/plain; format=edh" }
+
+func (edhFormat) Parse(r io.Reader) (*Decklist, error) {
+	return parseSectioned(r, false, true)
+}
+
+func (edhFormat) Write(w io.Writer, list *Decklist) error {
+	return writeSectioned(w, list, true)
+}
+
+func (edhFormat) Sniff(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.ToLower(strings.TrimSpace(line)) == "commander" {
+			return true
+		}
+	}
+	return false
+}
+
+// txtFormat is the plain flat list donkeytownsfolk has always accepted in its
+// staging-area textareas: one "N Name" per line, with an optional second
+// blank-line-separated block treated as the sideboard. No commander support,
+// no set codes. Write labels its blocks with "Deck"/"Sideboard" header lines,
+// which Parse reads back but the textareas' own parser does not.
+type txtFormat struct{}
+
+func (txtFormat) MediaType() string { return "text/plain" }
+
+func (txtFormat) Parse(r io.Reader) (*Decklist, error) {
+	return parseSectioned(r, false, false)
+}
+
+func (txtFormat) Write(w io.Writer, list *Decklist) error {
+	return writeSectioned(w, list, false)
+}
@@ -0,0 +1,69 @@
+//go:build headless
+// +build headless
+
+package donkeytownsfolk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// browserPool hands out a single shared chromedp allocator context so a full scrape
+// reuses one Chrome instance instead of launching a new one per page.
+type browserPoolT struct {
+	mu       sync.Mutex
+	allocCtx context.Context
+	cancel   context.CancelFunc
+}
+
+var browserPool browserPoolT
+
+func (p *browserPoolT) context() context.Context {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.allocCtx == nil {
+		p.allocCtx, p.cancel = chromedp.NewExecAllocator(context.Background())
+	}
+	return p.allocCtx
+}
+
+// renderPage navigates to url in the shared headless Chrome instance, waits for
+// waitSelector to appear (if given), and returns the fully-rendered HTML.
+func renderPage(ctx context.Context, url string, waitSelector string) (string, error) {
+	tabCtx, cancel := chromedp.NewContext(browserPool.context())
+	defer cancel()
+
+	tabCtx, timeoutCancel := context.WithTimeout(tabCtx, 30*time.Second)
+	defer timeoutCancel()
+
+	// The tab is rooted at the shared allocator, not ctx, so it can't inherit
+	// ctx's cancellation the usual way - watch it ourselves and tear the tab
+	// down if the caller gives up, the same as httpfetcher.go's
+	// cancellation-aware paths.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	var html string
+	actions := []chromedp.Action{chromedp.Navigate(url)}
+	if waitSelector != "" {
+		actions = append(actions, chromedp.WaitVisible(waitSelector, chromedp.ByQuery))
+	}
+	actions = append(actions, chromedp.OuterHTML("html", &html))
+
+	if err := chromedp.Run(tabCtx, actions...); err != nil {
+		return "", fmt.Errorf("headless render of %s failed: %s", url, err.Error())
+	}
+	return html, nil
+}
@@ -0,0 +1,16 @@
+//go:build !headless
+// +build !headless
+
+package donkeytownsfolk
+
+import (
+	"context"
+	"fmt"
+)
+
+// renderPage is stubbed out unless the binary is built with the "headless" build
+// tag (go build -tags headless), so users who don't need chromedp aren't forced to
+// pull in the dependency.
+func renderPage(ctx context.Context, url string, waitSelector string) (string, error) {
+	return "", fmt.Errorf("headless rendering requested for %s, but this binary wasn't built with -tags headless", url)
+}
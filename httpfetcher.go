@@ -0,0 +1,328 @@
+package donkeytownsfolk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// userAgents is rotated through per-request so we don't look like the same bot on
+// every hit. These are just realistic desktop browser strings, not tied to any
+// particular version.
+var userAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+}
+
+// rateLimiter is a simple token bucket that enforces a minimum delay between
+// requests to a single host, replacing the old hard-coded time.Sleep(1s).
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{interval: interval, last: map[string]time.Time{}}
+}
+
+// wait blocks until it's been at least interval since the last request to host, or
+// ctx is cancelled.
+func (rl *rateLimiter) wait(ctx context.Context, host string) error {
+	rl.mu.Lock()
+	last, ok := rl.last[host]
+	rl.mu.Unlock()
+
+	if ok {
+		if d := rl.interval - time.Since(last); d > 0 {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	rl.mu.Lock()
+	rl.last[host] = time.Now()
+	rl.mu.Unlock()
+	return nil
+}
+
+// FetchError is a typed error returned by httpFetcher when a page can't be
+// retrieved or parsed, so callers can distinguish "server is down" from
+// "the page changed shape" without string-matching error text.
+type FetchError struct {
+	Url        string
+	StatusCode int // zero if the request never got an HTTP response
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("fetch %s: status %d: %s", e.Url, e.StatusCode, e.Err.Error())
+	}
+	return fmt.Sprintf("fetch %s: %s", e.Url, e.Err.Error())
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// httpFetcher retrieves and parses HTML pages for the scrapers, with retries,
+// jittered exponential backoff, User-Agent rotation and per-host rate limiting
+// built in. All goquery-based price sources should fetch pages through this
+// instead of calling goquery.NewDocument directly.
+type httpFetcher struct {
+	client      *http.Client
+	limiter     *rateLimiter
+	maxAttempts int
+	baseBackoff time.Duration
+
+	cache   *webCache
+	noCache bool
+}
+
+// defaultScrapeCacheDir is where cached scrape pages live unless SetScrapeCacheDir
+// is called with something else.
+var defaultScrapeCacheDir = "/tmp/donkeytownsfolk-scrape-cache"
+
+// SetScrapeCacheDir changes where the shared fetcher caches scraped pages on disk.
+func SetScrapeCacheDir(dir string) {
+	fetcher.cache = newWebCache(dir)
+}
+
+// SetScrapeCacheDisabled lets ScrapeForever be run with caching off entirely
+// (e.g. via a --no-cache flag), so every scrape hits the real sites.
+func SetScrapeCacheDisabled(disabled bool) {
+	fetcher.noCache = disabled
+}
+
+func newHttpFetcher() *httpFetcher {
+	return &httpFetcher{
+		client:      &http.Client{},
+		limiter:     newRateLimiter(time.Second),
+		maxAttempts: 4,
+		baseBackoff: 500 * time.Millisecond,
+		cache:       newWebCache(defaultScrapeCacheDir),
+	}
+}
+
+// Fetcher is the subset of httpFetcher that other packages (e.g. configscraper) are
+// allowed to depend on, so external PriceSource implementations get the same
+// retry/backoff/rate-limit behavior as the built-in ones without reaching into
+// package internals.
+type Fetcher interface {
+	Get(ctx context.Context, url string) (*goquery.Document, error)
+	GetBytes(ctx context.Context, url string) ([]byte, error)
+
+	// GetRendered navigates to url in a headless browser, waits for waitSelector to
+	// appear, then parses the rendered HTML the same way Get does. Only available
+	// when the binary is built with the "headless" build tag; see headlessbrowser.go
+	// and headlessbrowser_stub.go.
+	GetRendered(ctx context.Context, url string, waitSelector string) (*goquery.Document, error)
+}
+
+// NewFetcher constructs a standalone Fetcher, with its own cache and rate limiter,
+// for callers that need isolation from the built-in sources. Most external
+// PriceSource implementations should use SharedFetcher instead, so they inherit the
+// same SetScrapeCacheDir/SetScrapeCacheDisabled controls and per-host rate limits as
+// tcgplayerSource/scryfallSource/mtggoldfishSource.
+func NewFetcher() Fetcher {
+	return newHttpFetcher()
+}
+
+// SharedFetcher returns the same httpFetcher every built-in PriceSource uses, so an
+// external PriceSource (e.g. configscraper's YAML-defined sources) reuses its
+// cache, rate limiter and the SetScrapeCacheDir/SetScrapeCacheDisabled knobs
+// instead of spinning up its own.
+func SharedFetcher() Fetcher {
+	return fetcher
+}
+
+// Get fetches url, retrying on network errors and 5xx/429 responses, and returns
+// the parsed document. Requests are paced through the fetcher's RateLimiter and
+// timed out according to ctx.
+func (f *httpFetcher) Get(ctx context.Context, url string) (*goquery.Document, error) {
+	body, err := f.getBytes(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, &FetchError{Url: url, Err: err}
+	}
+	return doc, nil
+}
+
+// GetBytes fetches url with the same retry/backoff/rate-limit behavior as Get, but
+// returns the raw response body instead of parsing it as HTML. Used by sources that
+// consume JSON (e.g. scryfallSource).
+func (f *httpFetcher) GetBytes(ctx context.Context, url string) ([]byte, error) {
+	return f.getBytes(ctx, url)
+}
+
+// cacheTTLContextKey is the context.Context key WithCacheTTL stores a PriceSource's
+// own Interval() under, so the shared fetcher's cache honors that source's refresh
+// cadence instead of always falling back to defaultCacheTTL.
+type cacheTTLContextKey struct{}
+
+// WithCacheTTL annotates ctx with how long a cached response should be considered
+// fresh for the request(s) made with it. scrapeOneSource calls this with the
+// PriceSource's own Interval() before invoking FetchAll, so e.g. Scryfall's 6-hour
+// bulk export doesn't get stuck serving a stale page for a full 24-hour default.
+func WithCacheTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, cacheTTLContextKey{}, ttl)
+}
+
+func cacheTTLFromContext(ctx context.Context) time.Duration {
+	if ttl, ok := ctx.Value(cacheTTLContextKey{}).(time.Duration); ok {
+		return ttl
+	}
+	return defaultCacheTTL
+}
+
+func (f *httpFetcher) getBytes(ctx context.Context, url string) ([]byte, error) {
+	if f.cache != nil && !f.noCache {
+		if body, ok := f.cache.get(url, cacheTTLFromContext(ctx)); ok {
+			return body, nil
+		}
+	}
+
+	body, err := f.getBytesUncached(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.cache != nil && !f.noCache {
+		// a cache write failure shouldn't fail the scrape - just means next time
+		// won't be a hit either
+		f.cache.put(url, body)
+	}
+
+	return body, nil
+}
+
+func (f *httpFetcher) getBytesUncached(ctx context.Context, url string) ([]byte, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < f.maxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := f.backoffDelay(attempt)
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, &FetchError{Url: url, Err: err}
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("User-Agent", userAgents[random.Intn(len(userAgents))])
+
+		if err := f.limiter.wait(ctx, req.URL.Host); err != nil {
+			return nil, err
+		}
+
+		resp, err := f.client.Do(req)
+		if err != nil {
+			lastErr = &FetchError{Url: url, Err: err}
+			continue
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			lastErr = &FetchError{Url: url, StatusCode: resp.StatusCode, Err: fmt.Errorf("server error")}
+			if retryAfter > 0 {
+				t := time.NewTimer(retryAfter)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					return nil, ctx.Err()
+				}
+			}
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = &FetchError{Url: url, StatusCode: resp.StatusCode, Err: err}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, &FetchError{Url: url, StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status")}
+		}
+
+		return body, nil
+	}
+
+	return nil, lastErr
+}
+
+// backoffDelay returns an exponentially growing delay (base * 2^(attempt-1)) plus
+// up to 50% random jitter, so a batch of retrying requests doesn't all land on the
+// server at the same instant.
+func (f *httpFetcher) backoffDelay(attempt int) time.Duration {
+	exp := time.Duration(math.Pow(2, float64(attempt-1))) * f.baseBackoff
+	jitter := time.Duration(random.Float64() * 0.5 * float64(exp))
+	return exp + jitter
+}
+
+// GetRendered waits for the rate limiter like Get/GetBytes do, then delegates to
+// renderPage - whose implementation depends on the "headless" build tag.
+func (f *httpFetcher) GetRendered(ctx context.Context, url string, waitSelector string) (*goquery.Document, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, &FetchError{Url: url, Err: err}
+	}
+	if err := f.limiter.wait(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	html, err := renderPage(ctx, url, waitSelector)
+	if err != nil {
+		return nil, &FetchError{Url: url, Err: err}
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader([]byte(html)))
+	if err != nil {
+		return nil, &FetchError{Url: url, Err: err}
+	}
+	return doc, nil
+}
+
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -4,8 +4,17 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func Init(r *mux.Router) error {
-	db, err := OpenDb()
+// Init wires up a full donkeytownsfolk instance - the database connection,
+// the background scraper, and the HTTP handlers - onto r. Passing a nil cfg
+// connects using DefaultConfig(), the same connection used before Config
+// existed; pass a *Config to point at a non-default URI (a replica set, an
+// in-memory/mongo2go instance for tests, etc).
+func Init(r *mux.Router, cfg *Config) error {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+
+	db, err := OpenDbWithConfig(cfg)
 	if err != nil {
 		return err
 	}
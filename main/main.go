@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/garbotron/donkeytownsfolk"
 	"github.com/gorilla/mux"
@@ -10,13 +11,21 @@ import (
 const httpPort = 8080
 
 func main() {
-	db, err := donkeytownsfolk.OpenDb()
-	if err != nil {
-		panic(err)
+	noCache := flag.Bool("no-cache", false, "disable the on-disk scrape cache and hit every price source live")
+	mongoUri := flag.String("mongo-uri", "", "MongoDB connection URI (defaults to a local, unauthenticated instance)")
+	flag.Parse()
+	donkeytownsfolk.SetScrapeCacheDisabled(*noCache)
+
+	cfg := donkeytownsfolk.DefaultConfig()
+	if *mongoUri != "" {
+		cfg.URI = *mongoUri
 	}
 
 	r := mux.NewRouter()
-	donkeytownsfolk.SetupRenderer(db, r)
+	if err := donkeytownsfolk.Init(r, cfg); err != nil {
+		panic(err)
+	}
+
 	http.Handle("/", r)
 	http.ListenAndServe(fmt.Sprintf(":%d", httpPort), nil)
 }
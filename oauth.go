@@ -0,0 +1,281 @@
+package donkeytownsfolk
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// oauthProvider describes one federated login provider's endpoints and how to pull
+// a verified email out of its userinfo response. Google and GitHub are built in;
+// adding another provider is a matter of adding another entry to oauthProviders.
+type oauthProvider struct {
+	Name           string
+	AuthUrl        string
+	TokenUrl       string
+	UserInfoUrl    string
+	Scope          string
+	ClientIdEnv    string
+	ClientSecret   string
+	parseUserEmail func(body []byte) (string, error)
+}
+
+var oauthProviders = map[string]*oauthProvider{
+	"google": {
+		Name:        "google",
+		AuthUrl:     "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenUrl:    "https://oauth2.googleapis.com/token",
+		UserInfoUrl: "https://www.googleapis.com/oauth2/v2/userinfo",
+		Scope:       "email",
+		ClientIdEnv: "DTK_GOOGLE_CLIENT_ID",
+		parseUserEmail: func(body []byte) (string, error) {
+			var v struct {
+				Email         string `json:"email"`
+				VerifiedEmail bool   `json:"verified_email"`
+			}
+			if err := json.Unmarshal(body, &v); err != nil {
+				return "", err
+			}
+			if !v.VerifiedEmail {
+				return "", errors.New("google account email is not verified")
+			}
+			return v.Email, nil
+		},
+	},
+	"github": {
+		Name:        "github",
+		AuthUrl:     "https://github.com/login/oauth/authorize",
+		TokenUrl:    "https://github.com/login/oauth/access_token",
+		UserInfoUrl: "https://api.github.com/user/emails",
+		Scope:       "user:email",
+		ClientIdEnv: "DTK_GITHUB_CLIENT_ID",
+		parseUserEmail: func(body []byte) (string, error) {
+			var emails []struct {
+				Email    string `json:"email"`
+				Primary  bool   `json:"primary"`
+				Verified bool   `json:"verified"`
+			}
+			if err := json.Unmarshal(body, &emails); err != nil {
+				return "", err
+			}
+			for _, e := range emails {
+				if e.Primary && e.Verified {
+					return e.Email, nil
+				}
+			}
+			return "", errors.New("github account has no verified primary email")
+		},
+	},
+}
+
+func (p *oauthProvider) clientId() string     { return os.Getenv(p.ClientIdEnv) }
+func (p *oauthProvider) clientSecret() string { return os.Getenv(p.ClientIdEnv + "_SECRET") }
+
+// setupOAuthRoutes wires up /oauth/{provider}/start and /oauth/{provider}/callback
+// for each registered provider, alongside the existing password-based login.
+func setupOAuthRoutes(db *Db, s *mux.Router, store SessionStore) {
+	s.HandleFunc("/oauth/{provider}/start", oauthStart(store))
+	s.HandleFunc("/oauth/{provider}/callback", createHandler(db, store, oauthCallback))
+}
+
+func oauthStart(store SessionStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := oauthProviders[mux.Vars(r)["provider"]]
+		if !ok {
+			http.Error(w, "Unknown OAuth provider", http.StatusNotFound)
+			return
+		}
+
+		state := generateOAuthState()
+		if err := setCookie(w, r, store, "oauth-state", state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redirectUri := oauthRedirectUri(r, provider.Name)
+		authUrl := fmt.Sprintf("%s?client_id=%s&redirect_uri=%s&scope=%s&response_type=code&state=%s",
+			provider.AuthUrl,
+			url.QueryEscape(provider.clientId()),
+			url.QueryEscape(redirectUri),
+			url.QueryEscape(provider.Scope),
+			url.QueryEscape(state))
+
+		http.Redirect(w, r, authUrl, http.StatusFound)
+	}
+}
+
+func oauthCallback(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
+	provider, ok := oauthProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		return errors.New("Unknown OAuth provider")
+	}
+
+	expectedState, _ := getCookie(r, store, "oauth-state").(string)
+	if expectedState == "" || r.FormValue("state") != expectedState {
+		return errors.New("OAuth state mismatch")
+	}
+	deleteCookie(w, r, store, "oauth-state")
+
+	code := r.FormValue("code")
+	if code == "" {
+		return errors.New("OAuth code not included")
+	}
+
+	accessToken, err := exchangeOAuthCode(provider, code, oauthRedirectUri(r, provider.Name))
+	if err != nil {
+		return err
+	}
+
+	email, err := fetchOAuthUserEmail(provider, accessToken)
+	if err != nil {
+		return err
+	}
+
+	user, err := findOrCreateOAuthUser(db, provider.Name, email)
+	if err != nil {
+		return err
+	}
+
+	if err := setCookie(w, r, store, "user", user.Name); err != nil {
+		return err
+	}
+	if err := updateSessionKey(user, w, r, db, store); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func exchangeOAuthCode(provider *oauthProvider, code string, redirectUri string) (string, error) {
+	form := url.Values{}
+	form.Set("client_id", provider.clientId())
+	form.Set("client_secret", provider.clientSecret())
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("grant_type", "authorization_code")
+
+	req, err := http.NewRequest("POST", provider.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", err
+	}
+	if tok.Error != "" {
+		return "", fmt.Errorf("oauth token exchange failed: %s", tok.Error)
+	}
+	return tok.AccessToken, nil
+}
+
+func fetchOAuthUserEmail(provider *oauthProvider, accessToken string) (string, error) {
+	req, err := http.NewRequest("GET", provider.UserInfoUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return provider.parseUserEmail(body)
+}
+
+// findOrCreateOAuthUser looks up the User linked to provider+email. If no user has
+// this provider identity linked yet, it falls back to matching by verified email
+// (User.Email, not Name - a password account's username has no relation to its
+// email) against any existing account and links this provider to it, rather than
+// failing with UserAlreadyExistsError. Only if neither match is found is a brand
+// new user created.
+func findOrCreateOAuthUser(db *Db, provider string, email string) (*User, error) {
+	users, err := db.AllUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range users {
+		if id, ok := u.OAuthIdentities[provider]; ok && id == email {
+			return u, nil
+		}
+	}
+
+	if u, err := db.FindUserByEmail(email); err == nil {
+		if err := db.LinkOAuthIdentity(u, provider, email); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	user, err := db.AddUser(email, email, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.LinkOAuthIdentity(user, provider, email); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// LinkOAuthIdentity links provider/email to user. findOrCreateOAuthUser is its
+// only caller; no HTTP route or page lets a user link or unlink a provider.
+func (db *Db) LinkOAuthIdentity(user *User, provider string, email string) error {
+	if user.OAuthIdentities == nil {
+		user.OAuthIdentities = map[string]string{}
+	}
+	user.OAuthIdentities[provider] = email
+	return db.UpdateUser(user)
+}
+
+// UnlinkOAuthIdentity removes a previously-linked provider identity from user.
+func (db *Db) UnlinkOAuthIdentity(user *User, provider string) error {
+	delete(user.OAuthIdentities, provider)
+	return db.UpdateUser(user)
+}
+
+func oauthRedirectUri(r *http.Request, provider string) string {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/oauth/%s/callback", scheme, r.Host, provider)
+}
+
+func generateOAuthState() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.URLEncoding.EncodeToString(b)
+}
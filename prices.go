@@ -2,51 +2,197 @@ package donkeytownsfolk
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
-	"math/rand"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+
+	"math/rand"
+	"sync"
 )
 
 var random = rand.New(rand.NewSource(time.Now().UTC().UnixNano()))
-var waitBetweenScrapes = 24 * time.Hour
 var freeCards = []string{"Plains", "Island", "Swamp", "Mountain", "Forest"}
 
+// scrapeMu serializes the load-merge-write cycle across every source's independent
+// scrapeSourceForever goroutine. Without it, two sources due on the same 30-second
+// tick each load the same baseline, merge only their own results, and the slower
+// writer clobbers the faster one's prices - exactly the lost-update mergePrices is
+// supposed to prevent.
+var scrapeMu sync.Mutex
+
+// fetcher is shared by every built-in PriceSource so they all retry, back off and
+// rate-limit consistently, and so a full scrape reuses one set of per-host timers.
+var fetcher = newHttpFetcher()
+
+func init() {
+	RegisterPriceSource(&tcgplayerSource{})
+	RegisterPriceSource(&scryfallSource{})
+	RegisterPriceSource(&mtggoldfishSource{})
+}
+
+// ScrapeForever runs every registered PriceSource on its own schedule (see
+// PriceSource.Interval), independently of the others, plus one goroutine that
+// periodically compacts price_history and one that sweeps expired
+// Deck.PendingChanges. A slow or down source no longer holds up
+// the others: each checks in on a 30-second tick and only actually scrapes once
+// its own Interval has elapsed since its last run.
 func (db *Db) ScrapeForever() {
+	for _, src := range registeredPriceSources() {
+		go db.scrapeSourceForever(src)
+	}
+	go db.compactHistoryForever()
+	go db.sweepPendingChangesForever()
+}
+
+func (db *Db) scrapeSourceForever(src PriceSource) {
 	c := time.Tick(30 * time.Second)
 	for now := range c {
-		stats, err := db.GetScraperStats()
-		if err != nil || stats.LastPriceUpdate.Add(waitBetweenScrapes).Before(now) {
-			db.scrapePricesPeriodic()
+		stats, err := db.GetSourceStats()
+		due := true
+		if err == nil {
+			if s, ok := stats[src.Name()]; ok {
+				due = s.LastRun.Add(src.Interval()).Before(now)
+			}
+		}
+		if due {
+			db.scrapeSourcePeriodic(src)
 		}
 	}
 }
 
-func (db *Db) scrapePricesPeriodic() {
-	err := db.scrapePrices()
-	if err == nil {
-		fmt.Println("Price scraper: complete!")
-		db.SetScraperStats(&ScraperStats{time.Now(), nil})
-	} else {
-		fmt.Println("Price scraper: failed!")
-		fmt.Println(err.Error())
-		db.SetScraperStats(&ScraperStats{time.Now(), err})
+func (db *Db) scrapeSourcePeriodic(src PriceSource) {
+	scrapeMu.Lock()
+	defer scrapeMu.Unlock()
+
+	stat := scrapeOneSource(context.Background(), db, src)
+	if err := db.SetSourceStats(map[string]*SourceStats{src.Name(): stat}); err != nil {
+		fmt.Printf("Price scraper: %s: couldn't save source stats: %s\n", src.Name(), err.Error())
 	}
+	if stat.LastError != nil {
+		return
+	}
+
+	if err := db.recomputeAndPersistMergedPrices(); err != nil {
+		fmt.Printf("Price scraper: %s: couldn't write prices: %s\n", src.Name(), err.Error())
+		return
+	}
+
+	db.SetScraperStats(&ScraperStats{LastPriceUpdate: time.Now()})
 }
 
-func (db *Db) scrapePrices() error {
-	doc, err := goquery.NewDocument("http://magic.tcgplayer.com/all_magic_sets.asp")
+func (db *Db) compactHistoryForever() {
+	c := time.Tick(24 * time.Hour)
+	for range c {
+		if err := db.CompactPriceHistory(); err != nil {
+			fmt.Println("Price scraper: history compaction failed!")
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// pendingChangeSweepInterval is how often sweepPendingChangesForever looks for
+// expired Deck.PendingChanges. IsSnapshotLegal also resolves pending changes on
+// the fly, so an hour of staleness here only delays materializing them into
+// PriceLimit/GrandfatherLegal, not the legality check itself.
+const pendingChangeSweepInterval = 1 * time.Hour
+
+func (db *Db) sweepPendingChangesForever() {
+	c := time.Tick(pendingChangeSweepInterval)
+	for range c {
+		if err := db.sweepPendingChanges(); err != nil {
+			fmt.Println("Pending-change sweeper failed!")
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+func (db *Db) sweepPendingChanges() error {
+	users, err := db.AllUsers()
 	if err != nil {
 		return err
 	}
 
+	for _, u := range users {
+		if !userHasExpiredPendingChanges(u) {
+			continue
+		}
+		if _, err := db.UpdateUserFunc(u.Name, materializePendingChanges); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func userHasExpiredPendingChanges(u *User) bool {
+	now := time.Now()
+	for _, d := range u.Decks {
+		for _, p := range d.PendingChanges {
+			if !p.EffectiveAt.After(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// materializePendingChanges applies every expired PendingChange straight to its
+// deck's PriceLimit/GrandfatherLegal and drops it from the queue, so only the
+// window between sweeps relies on IsSnapshotLegal's on-the-fly resolution. As
+// in resolveEffectiveLimitAndGrandfather, each field is decided independently
+// by whichever expired change has the latest EffectiveAt, not by queue order.
+func materializePendingChanges(u *User) error {
+	now := time.Now()
+	for _, d := range u.Decks {
+		var limitChange, grandfatherChange *PendingChange
+		remaining := d.PendingChanges[:0]
+		for _, p := range d.PendingChanges {
+			if p.EffectiveAt.After(now) {
+				remaining = append(remaining, p)
+				continue
+			}
+			if p.NewPriceLimit != nil && (limitChange == nil || p.EffectiveAt.After(limitChange.EffectiveAt)) {
+				limitChange = p
+			}
+			if p.NewGrandfather != nil && (grandfatherChange == nil || p.EffectiveAt.After(grandfatherChange.EffectiveAt)) {
+				grandfatherChange = p
+			}
+		}
+		if limitChange != nil {
+			d.PriceLimit = *limitChange.NewPriceLimit
+		}
+		if grandfatherChange != nil {
+			d.GrandfatherLegal = *grandfatherChange.NewGrandfather
+		}
+		d.PendingChanges = remaining
+	}
+	return nil
+}
+
+// tcgplayerSource scrapes the (now legacy) TCGPlayer set-browsing pages. This is the
+// original scraper that donkeytownsfolk shipped with, lifted verbatim into the
+// PriceSource interface.
+type tcgplayerSource struct{}
+
+func (s *tcgplayerSource) Name() string               { return "tcgplayer" }
+func (s *tcgplayerSource) Domains() []string          { return []string{"magic.tcgplayer.com"} }
+func (s *tcgplayerSource) RendererMode() RendererMode { return ModeStatic }
+func (s *tcgplayerSource) Interval() time.Duration    { return DefaultSourceInterval }
+
+func (s *tcgplayerSource) FetchAll(ctx context.Context) ([]*PriceDbEntry, error) {
+	doc, err := fetcher.Get(ctx, "http://magic.tcgplayer.com/all_magic_sets.asp")
+	if err != nil {
+		return nil, err
+	}
+
 	setLinks := []string{}
-	doc.Find("a").Each(func(i int, s *goquery.Selection) {
+	doc.Find("a").Each(func(i int, sel *goquery.Selection) {
 		prefix := "/db/search_result.asp?set_name="
-		val, exists := s.Attr("href")
+		val, exists := sel.Attr("href")
 		if exists && strings.HasPrefix(strings.ToLower(val), prefix) {
 			if strings.HasSuffix(val, "Magic 2010") {
 				// I have no idea why, but the link for M10 is wrong...
@@ -56,48 +202,34 @@ func (db *Db) scrapePrices() error {
 		}
 	})
 
-	lowestPrice := map[string]*PriceDbEntry{}
+	allEntries := []*PriceDbEntry{}
 	for _, link := range setLinks {
-		entries, err := scrapePage(link)
+		entries, err := scrapeTcgplayerSetPage(ctx, link)
 		if err != nil {
-			return err
-		}
-		for _, e := range entries {
-			val, exists := lowestPrice[e.ID]
-			if !exists || e.Price < val.Price {
-				lowestPrice[e.ID] = e
-			}
+			return nil, err
 		}
-		fmt.Printf("Price scraper: finished %s\n", link)
-	}
-
-	allEntries := make([]*PriceDbEntry, len(lowestPrice))
-	i := 0
-	for _, e := range lowestPrice {
-		allEntries[i] = e
-		i++
+		allEntries = append(allEntries, entries...)
+		fmt.Printf("Price scraper: tcgplayer finished %s\n", link)
 	}
 
-	return db.UpdateAllPrices(allEntries)
+	return allEntries, nil
 }
 
-func scrapePage(url string) ([]*PriceDbEntry, error) {
-	time.Sleep(1000 * time.Millisecond) // just so we don't DoS the server too badly
-
+func scrapeTcgplayerSetPage(ctx context.Context, url string) ([]*PriceDbEntry, error) {
 	url = strings.Replace(url, " ", "+", -1) // sometimes the links come in this way (no idea why)
 
-	doc, err := goquery.NewDocument(url)
+	doc, err := fetcher.Get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
 	entries := []*PriceDbEntry{}
-	doc.Find("td").Each(func(i int, s *goquery.Selection) {
-
+	var parseErr error
+	doc.Find("td").EachWithBreak(func(i int, s *goquery.Selection) bool {
 		bgColors := []string{"#D1DFFC", "#E6F4FF"}
 		val, exists := s.Attr("bgcolor")
 		if !exists {
-			return
+			return true
 		}
 
 		isCorrectColor := false
@@ -108,23 +240,23 @@ func scrapePage(url string) ([]*PriceDbEntry, error) {
 		}
 
 		if !isCorrectColor {
-			return
+			return true
 		}
 
 		val, exists = s.Find("a").Attr("href")
 		if !exists {
-			return
+			return true
 		}
 
 		idx := strings.Index(val, "cn=")
 		if idx < 0 {
-			return
+			return true
 		}
 
 		val = val[idx+3:]
 		idx = strings.Index(val, "&")
 		if idx < 0 {
-			return
+			return true
 		}
 		cardName := val[0:idx]
 
@@ -134,17 +266,143 @@ func scrapePage(url string) ([]*PriceDbEntry, error) {
 		price = strings.Replace(price, ",", "", -1)
 		priceFloat, err := strconv.ParseFloat(price, 64)
 		if err != nil {
-			panic(err)
+			parseErr = fmt.Errorf("tcgplayer: couldn't parse price %q for %q: %s", price, cardName, err.Error())
+			return false
 		}
 
 		entries = append(
 			entries,
-			&PriceDbEntry{nameToId(cardName), cardName, Money(priceFloat)})
+			&PriceDbEntry{ID: nameToId(cardName), Name: cardName, Price: Money(priceFloat)})
+		return true
 	})
 
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
 	return entries, nil
 }
 
+// scryfallSource reads Scryfall's bulk "default_cards" price data, which ships as a
+// single large JSON array and is (unlike TCGPlayer's HTML) actually meant to be
+// consumed by bots.
+type scryfallSource struct{}
+
+func (s *scryfallSource) Name() string               { return "scryfall" }
+func (s *scryfallSource) Domains() []string          { return []string{"api.scryfall.com", "data.scryfall.io"} }
+func (s *scryfallSource) RendererMode() RendererMode { return ModeStatic }
+
+// Interval is shorter than the default: Scryfall publishes its bulk export every
+// few hours and it's cheap to pull (one JSON file, no per-set crawling), so there's
+// no reason to let it go as stale as the HTML-scraping sources.
+func (s *scryfallSource) Interval() time.Duration { return 6 * time.Hour }
+
+type scryfallBulkDataEntry struct {
+	Type        string `json:"type"`
+	DownloadUri string `json:"download_uri"`
+}
+
+type scryfallCard struct {
+	Name   string `json:"name"`
+	Prices struct {
+		Usd string `json:"usd"`
+	} `json:"prices"`
+}
+
+func (s *scryfallSource) FetchAll(ctx context.Context) ([]*PriceDbEntry, error) {
+	indexBytes, err := fetcher.GetBytes(ctx, "https://api.scryfall.com/bulk-data")
+	if err != nil {
+		return nil, err
+	}
+
+	var index struct {
+		Data []scryfallBulkDataEntry `json:"data"`
+	}
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, fmt.Errorf("scryfall: couldn't parse bulk-data index: %s", err.Error())
+	}
+
+	var downloadUri string
+	for _, e := range index.Data {
+		if e.Type == "default_cards" {
+			downloadUri = e.DownloadUri
+			break
+		}
+	}
+	if downloadUri == "" {
+		return nil, fmt.Errorf("scryfall: no default_cards bulk file found")
+	}
+
+	cardBytes, err := fetcher.GetBytes(ctx, downloadUri)
+	if err != nil {
+		return nil, err
+	}
+
+	var cards []scryfallCard
+	if err := json.Unmarshal(cardBytes, &cards); err != nil {
+		return nil, fmt.Errorf("scryfall: couldn't parse bulk card list: %s", err.Error())
+	}
+
+	entries := []*PriceDbEntry{}
+	for _, c := range cards {
+		if c.Prices.Usd == "" {
+			continue
+		}
+		price, err := strconv.ParseFloat(c.Prices.Usd, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, &PriceDbEntry{ID: nameToId(c.Name), Name: c.Name, Price: Money(price)})
+	}
+
+	return entries, nil
+}
+
+// mtggoldfishSource scrapes MTGGoldfish's "all cards" price index, giving a second
+// independent data point to cross-check TCGPlayer/Scryfall against.
+type mtggoldfishSource struct{}
+
+func (s *mtggoldfishSource) Name() string               { return "mtggoldfish" }
+func (s *mtggoldfishSource) Domains() []string          { return []string{"www.mtggoldfish.com"} }
+func (s *mtggoldfishSource) RendererMode() RendererMode { return ModeStatic }
+func (s *mtggoldfishSource) Interval() time.Duration    { return DefaultSourceInterval }
+
+func (s *mtggoldfishSource) FetchAll(ctx context.Context) ([]*PriceDbEntry, error) {
+	doc, err := fetcher.Get(ctx, "https://www.mtggoldfish.com/index")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*PriceDbEntry{}
+	doc.Find("table.index-price-table tr").Each(func(i int, row *goquery.Selection) {
+		cardName := strings.TrimSpace(row.Find("td.card-name").Text())
+		priceText := strings.TrimSpace(row.Find("td.price").Text())
+		priceText = strings.TrimPrefix(priceText, "$")
+		priceText = strings.Replace(priceText, ",", "", -1)
+
+		if cardName == "" || priceText == "" {
+			return
+		}
+
+		price, err := strconv.ParseFloat(priceText, 64)
+		if err != nil {
+			return
+		}
+
+		entries = append(entries, &PriceDbEntry{ID: nameToId(cardName), Name: cardName, Price: Money(price)})
+	})
+
+	return entries, nil
+}
+
+// NewPriceDbEntry builds a PriceDbEntry from a raw card name, deriving its ID the
+// same way the built-in sources do. External PriceSource implementations (e.g.
+// configscraper) should use this rather than constructing PriceDbEntry by hand, so
+// IDs stay consistent across sources.
+func NewPriceDbEntry(name string, price Money) *PriceDbEntry {
+	return &PriceDbEntry{ID: nameToId(name), Name: name, Price: price}
+}
+
 // creates an ID from a name by trimming all non-alphanumeric characters
 func nameToId(name string) string {
 	buffer := bytes.Buffer{}
@@ -159,36 +417,67 @@ func nameToId(name string) string {
 // calculates all of the prices for each card
 func (s *Snapshot) CalculatePrices(db *Db) {
 	if s.Commander.IsPresent {
-		n, p, exists := calculateNameAndPrice(db, s.Commander.Name)
+		n, p, src, exists := calculateNameAndPrice(db, s.Commander.Name)
 		s.Commander.Name = n
 		s.Commander.Price = p
+		s.Commander.Source = src
 		s.Commander.NotFound = !exists
 	}
-	for _, c := range s.Decklist {
-		c.calculateNameAndPrice(db)
+
+	all := make([]*CardEntry, 0, len(s.Decklist)+len(s.Sideboard))
+	all = append(all, s.Decklist...)
+	all = append(all, s.Sideboard...)
+
+	ids := make([]string, 0, len(all))
+	for _, c := range all {
+		n, p, src, exists := calculateNameAndPrice(db, c.Name)
+		c.Name = n
+		c.PricePer = p
+		c.Source = src
+		c.NotFound = !exists
+		if exists {
+			ids = append(ids, nameToId(n))
+		}
+	}
+
+	// One batched pricesAtOrBefore lookup for every card in the snapshot, instead
+	// of one query per card - a deck render is the hot path for this.
+	past, err := db.pricesAtOrBefore(ids, time.Now().AddDate(0, 0, -30))
+	if err != nil {
+		past = map[string]*PricePoint{}
 	}
-	for _, c := range s.Sideboard {
-		c.calculateNameAndPrice(db)
+	for _, c := range all {
+		c.PricePer30dAgo, c.PctChange = priceTrend(past, nameToId(c.Name), c.PricePer, !c.NotFound)
 	}
 }
 
-func (c *CardEntry) calculateNameAndPrice(db *Db) {
-	n, p, exists := calculateNameAndPrice(db, c.Name)
-	c.Name = n
-	c.PricePer = p
-	c.NotFound = !exists
+// priceTrend looks up cardId's 30-day-ago price in past (populated in bulk by
+// CalculatePrices) and compares it to the card's current price, so decklist views
+// can flag cards that have spiked recently. It's best-effort: a missing history
+// point just leaves PricePer30dAgo/PctChange at zero.
+func priceTrend(past map[string]*PricePoint, cardId string, currentPrice Money, found bool) (Money, float64) {
+	if !found {
+		return Free, 0
+	}
+
+	p, ok := past[cardId]
+	if !ok || p.Price == Free {
+		return Free, 0
+	}
+
+	return p.Price, (float64(currentPrice) - float64(p.Price)) / float64(p.Price) * 100
 }
 
-func calculateNameAndPrice(db *Db, origName string) (string, Money, bool) {
+func calculateNameAndPrice(db *Db, origName string) (string, Money, string, bool) {
 	id := nameToId(origName)
 	for _, x := range freeCards {
 		if id == nameToId(x) {
-			return x, Free, true
+			return x, Free, "", true
 		}
 	}
-	n, p, err := db.NameAndPrice(id)
+	n, p, src, err := db.NameAndPrice(id)
 	if err != nil {
-		return origName, Free, false
+		return origName, Free, "", false
 	}
-	return n, p, true
+	return n, p, src, true
 }
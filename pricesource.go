@@ -0,0 +1,207 @@
+package donkeytownsfolk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultSourceInterval is the scrape interval a PriceSource gets if it doesn't
+// need anything different from the rest - once a day is plenty for card prices,
+// which don't move fast enough to justify hammering these sites any harder.
+const DefaultSourceInterval = 24 * time.Hour
+
+// PriceSource is a pluggable provider of card prices. Built-in sources live in this
+// package (tcgplayerSource, scryfallSource, mtggoldfishSource); callers can register
+// their own (CardKingdom, ChannelFireball, a local CSV, ...) via RegisterPriceSource
+// without touching the core scraping code.
+type PriceSource interface {
+	// Name identifies the source for logging and SourceStats.
+	Name() string
+
+	// Domains lists the hostnames this source fetches from, mostly for diagnostics.
+	Domains() []string
+
+	// RendererMode reports whether this source's pages need a headless browser to
+	// render JavaScript-generated prices, or can be fetched as plain static HTML.
+	RendererMode() RendererMode
+
+	// Interval is how often Db.ScrapeForever re-runs this source. Sources that
+	// ship bulk data cheaply (e.g. Scryfall's bulk export) can return something
+	// shorter than DefaultSourceInterval; sources that are expensive or rate-
+	// limited can return something longer.
+	Interval() time.Duration
+
+	// FetchAll returns every known card/price pair from this source.
+	FetchAll(ctx context.Context) ([]*PriceDbEntry, error)
+}
+
+// SourceStats records the outcome of the most recent scrape of a single PriceSource.
+type SourceStats struct {
+	LastRun    time.Time
+	LastError  error
+	CardCount  int
+	DurationMs int64
+}
+
+var (
+	sourcesMu      sync.Mutex
+	priceSources   = []PriceSource{}
+	registeredName = map[string]bool{}
+)
+
+// RegisterPriceSource adds src to the set of sources that Db.ScrapeForever and
+// Db.ScrapeAllSources fan out to. It's expected to be called during program setup,
+// before Init. Registration order matters: it's the tie-breaker when two sources
+// report the same price for a card (see mergePrices).
+func RegisterPriceSource(src PriceSource) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	if registeredName[src.Name()] {
+		panic(fmt.Sprintf("price source %q already registered", src.Name()))
+	}
+	registeredName[src.Name()] = true
+	priceSources = append(priceSources, src)
+}
+
+func registeredPriceSources() []PriceSource {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	ret := make([]PriceSource, len(priceSources))
+	copy(ret, priceSources)
+	return ret
+}
+
+// mergePrices rebuilds the full per-card price map from scratch out of every
+// source's most recently fetched full price list, applying the documented
+// precedence rule: the lowest price for a card wins across sources, with ties
+// broken in favor of whichever source registered first (priceSources is walked in
+// registration order, and a tie only overwrites on a strictly lower price). This
+// always recomputes from each source's latest snapshot rather than merging fresh
+// results against the persisted winner, so a source raising its own price - or a
+// transient low from a sale or a one-off misparse - is reflected immediately
+// instead of the stored price only ever being able to fall.
+func mergePrices(sourcePrices map[string][]*PriceDbEntry) map[string]*PriceDbEntry {
+	merged := map[string]*PriceDbEntry{}
+	for _, src := range registeredPriceSources() {
+		for _, e := range sourcePrices[src.Name()] {
+			e.Source = src.Name()
+			if cur, ok := merged[e.ID]; !ok || e.Price < cur.Price {
+				merged[e.ID] = e
+			}
+		}
+	}
+	return merged
+}
+
+// scrapeOneSource runs a single PriceSource to completion and persists its raw
+// result as that source's latest snapshot, for mergePrices to fold in later. A
+// fetch error is recorded in the returned stats rather than returned, so a single
+// misbehaving source never aborts a scrape of the others.
+func scrapeOneSource(ctx context.Context, db *Db, src PriceSource) *SourceStats {
+	start := time.Now()
+	entries, err := src.FetchAll(WithCacheTTL(ctx, src.Interval()))
+	stat := &SourceStats{LastRun: start, DurationMs: time.Since(start).Milliseconds()}
+
+	if err != nil {
+		stat.LastError = err
+		fmt.Printf("Price scraper: source %q failed: %s\n", src.Name(), err.Error())
+		return stat
+	}
+	stat.CardCount = len(entries)
+
+	if err := db.SetSourcePrices(src.Name(), entries); err != nil {
+		stat.LastError = err
+		fmt.Printf("Price scraper: source %q: couldn't save prices: %s\n", src.Name(), err.Error())
+		return stat
+	}
+
+	fmt.Printf("Price scraper: source %q finished (%d cards)\n", src.Name(), len(entries))
+	return stat
+}
+
+// recomputeAndPersistMergedPrices rebuilds the prices collection from every
+// source's latest stored snapshot (see scrapeOneSource/SetSourcePrices) and records
+// a price_history point for every card whose merged price or winning source
+// changed since the last write.
+func (db *Db) recomputeAndPersistMergedPrices() error {
+	sourcePrices, err := db.GetAllSourcePrices()
+	if err != nil {
+		return err
+	}
+	previous, err := db.loadAllPrices()
+	if err != nil {
+		return err
+	}
+
+	merged := mergePrices(sourcePrices)
+
+	changed := make([]*PriceDbEntry, 0, len(merged))
+	for id, e := range merged {
+		if prev, ok := previous[id]; !ok || prev.Price != e.Price || prev.Source != e.Source {
+			changed = append(changed, e)
+		}
+	}
+
+	return db.writeMergedPrices(merged, changed)
+}
+
+// ScrapeAllSources runs every registered PriceSource once, then recomputes and
+// persists the merged prices, the history deltas, and each source's SourceStats.
+// Db.ScrapeForever is the steady-state path that runs each source on its own
+// Interval(); this is the all-at-once equivalent, useful for an initial seed or an
+// admin-triggered full re-scrape.
+func (db *Db) ScrapeAllSources(ctx context.Context) error {
+	sources := registeredPriceSources()
+	if len(sources) == 0 {
+		return fmt.Errorf("no price sources registered")
+	}
+
+	scrapeMu.Lock()
+	defer scrapeMu.Unlock()
+
+	perSource := map[string]*SourceStats{}
+	for _, src := range sources {
+		perSource[src.Name()] = scrapeOneSource(ctx, db, src)
+	}
+
+	if err := db.recomputeAndPersistMergedPrices(); err != nil {
+		return err
+	}
+
+	return db.SetSourceStats(perSource)
+}
+
+// loadAllPrices reads the prices collection into a map keyed by card ID, so
+// recomputeAndPersistMergedPrices can tell which merged prices changed since the
+// last write.
+func (db *Db) loadAllPrices() (map[string]*PriceDbEntry, error) {
+	c := db.db.DB(MongoDbName).C(MongoPricesCollectionName)
+	list := []*PriceDbEntry{}
+	if err := c.Find(nil).All(&list); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]*PriceDbEntry, len(list))
+	for _, e := range list {
+		ret[e.ID] = e
+	}
+	return ret, nil
+}
+
+// writeMergedPrices persists the full merged set and appends history points for
+// just the entries that changed this pass.
+func (db *Db) writeMergedPrices(merged map[string]*PriceDbEntry, changed []*PriceDbEntry) error {
+	allEntries := make([]*PriceDbEntry, 0, len(merged))
+	for _, e := range merged {
+		allEntries = append(allEntries, e)
+	}
+
+	if err := db.UpdateAllPrices(allEntries); err != nil {
+		return err
+	}
+	return db.AppendPriceHistory(changed)
+}
@@ -3,16 +3,15 @@ package donkeytownsfolk
 import (
 	"bytes"
 	"code.google.com/p/go.crypto/bcrypt"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
-	"github.com/gorilla/sessions"
 	"html/template"
 	"io"
 	"net/http"
 	"os"
-	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -24,6 +23,7 @@ type templateData struct {
 	InfoMessage  string
 	ErrorMessage string
 	SearchText   string
+	CSRFToken    string
 }
 
 type deckData struct {
@@ -47,13 +47,16 @@ func SetupRenderer(db *Db, r *mux.Router) {
 	// require our specific subdomain
 	s := r.Host(Domain).Subrouter()
 
-	// create the secure cookie store for Gorilla sessions
-	store := sessions.NewCookieStore(masterKey())
-
-	// serve files under /static using a standard file system server
-	localStaticRoot := os.ExpandEnv("$GOPATH/src/github.com/garbotron/donkeytownsfolk/static")
+	// create the session store - backend (cookie/filesystem/redis) is selected
+	// via DT_SESSION_BACKEND, see sessionstore.go
+	store, err := NewSessionStore()
+	if err != nil {
+		panic(err)
+	}
 
-	s.Handle("/static/{path:.*}", http.StripPrefix("/static/", http.FileServer(http.Dir(localStaticRoot))))
+	// serve files under /static, falling back to the embedded copy if there's no
+	// on-disk checkout (see staticFileSystem in templateregistry.go)
+	s.Handle("/static/{path:.*}", http.StripPrefix("/static/", http.FileServer(staticFileSystem())))
 
 	// hookup all dynamic handlers
 	s.HandleFunc("/", createHandler(db, store, renderFilterPage))
@@ -71,13 +74,20 @@ func SetupRenderer(db *Db, r *mux.Router) {
 	s.HandleFunc("/save-snapshot", createHandler(db, store, performSaveSnapshot))
 	s.HandleFunc("/revert-changes", createHandler(db, store, performRevertChanges))
 	s.HandleFunc("/clear-history", createHandler(db, store, performClearHistory))
+	s.HandleFunc("/schedule-change", createHandler(db, store, performScheduleChange))
+	s.HandleFunc("/price-history.json", createHandler(db, store, renderPriceHistoryJson))
+	s.HandleFunc("/price-history.svg", createHandler(db, store, renderPriceHistorySparkline))
+
+	setupApiRoutes(db, s)
+	setupOAuthRoutes(db, s, store)
+	setupDeckExportRoutes(db, s, store)
 }
 
 func masterKey() []byte {
 	return []byte(os.Getenv("DTKEY"))
 }
 
-func getCookie(r *http.Request, store *sessions.CookieStore, name string) interface{} {
+func getCookie(r *http.Request, store SessionStore, name string) interface{} {
 	session, err := store.Get(r, sessionName)
 	if err != nil {
 		return struct{}{}
@@ -91,7 +101,7 @@ func getCookie(r *http.Request, store *sessions.CookieStore, name string) interf
 	}
 }
 
-func setCookie(w http.ResponseWriter, r *http.Request, store *sessions.CookieStore, name string, val interface{}) error {
+func setCookie(w http.ResponseWriter, r *http.Request, store SessionStore, name string, val interface{}) error {
 	session, err := store.Get(r, sessionName)
 	if err != nil && err.Error() != securecookie.ErrMacInvalid.Error() {
 		// ignore un-decodable saved session (the returned session will still be valid)
@@ -102,7 +112,7 @@ func setCookie(w http.ResponseWriter, r *http.Request, store *sessions.CookieSto
 	return session.Save(r, w)
 }
 
-func deleteCookie(w http.ResponseWriter, r *http.Request, store *sessions.CookieStore, name string) error {
+func deleteCookie(w http.ResponseWriter, r *http.Request, store SessionStore, name string) error {
 	session, err := store.Get(r, sessionName)
 	if err != nil && err.Error() != securecookie.ErrMacInvalid.Error() {
 		// ignore un-decodable saved session (the returned session will still be valid)
@@ -113,7 +123,7 @@ func deleteCookie(w http.ResponseWriter, r *http.Request, store *sessions.Cookie
 	return session.Save(r, w)
 }
 
-func findLoggedInUser(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) (*User, error) {
+func findLoggedInUser(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) (*User, error) {
 	if userName, ok := getCookie(r, store, "user").(string); ok {
 		if sessionKey, ok := getCookie(r, store, "session-key").([]byte); ok {
 			if user, err := db.FindUser(userName); err == nil {
@@ -128,7 +138,7 @@ func findLoggedInUser(w http.ResponseWriter, r *http.Request, db *Db, store *ses
 	return nil, UserNotFoundError
 }
 
-func updateSessionKey(user *User, w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func updateSessionKey(user *User, w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	key := securecookie.GenerateRandomKey(32)
 
 	user.SessionKey = key
@@ -139,20 +149,7 @@ func updateSessionKey(user *User, w http.ResponseWriter, r *http.Request, db *Db
 	return setCookie(w, r, store, "session-key", key)
 }
 
-func renderTemplate(name string, w io.Writer, data interface{}) error {
-	localTemplateRoot := os.ExpandEnv("$GOPATH/src/github.com/garbotron/donkeytownsfolk/templates")
-	templatePath := path.Join(localTemplateRoot, name)
-	headerPath := path.Join(localTemplateRoot, "header.template")
-	footerPath := path.Join(localTemplateRoot, "footer.template")
-	if t, err := template.ParseFiles(templatePath, headerPath, footerPath); err != nil {
-		return err
-	} else {
-		t.Execute(w, data)
-		return nil
-	}
-}
-
-func redirectForError(w http.ResponseWriter, r *http.Request, store *sessions.CookieStore, err error, page string) {
+func redirectForError(w http.ResponseWriter, r *http.Request, store SessionStore, err error, page string) {
 	// for our error page, we're just going to use the main filter page with an error info text blob
 	setCookie(w, r, store, "error", err.Error())
 	http.Redirect(w, r, page, http.StatusFound)
@@ -160,34 +157,24 @@ func redirectForError(w http.ResponseWriter, r *http.Request, store *sessions.Co
 
 func createHandler(
 	db *Db,
-	store *sessions.CookieStore,
-	f func(http.ResponseWriter, *http.Request, *Db, *sessions.CookieStore) error) func(http.ResponseWriter, *http.Request) {
+	store SessionStore,
+	f func(http.ResponseWriter, *http.Request, *Db, SessionStore) error) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkCsrfToken(r, store); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if err := f(w, r, db, store); err != nil {
 			redirectForError(w, r, store, err, "/")
 		}
 	}
 }
 
-func getFilterResults(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) *filterResult {
+func getFilterResults(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) *filterResult {
 	result := &filterResult{}
 
-	// first build the entire sorted list of all decks (sorted by deck name)
-	result.AllDecks = []*deckData{}
-
 	searchTerms := strings.Split(r.FormValue("search"), " ")
 
-	allUsers := []*User{}
-	if u := r.FormValue("user"); u != "" {
-		if user, err := db.FindUser(u); err == nil {
-			allUsers = []*User{user}
-		}
-	} else {
-		if u, err := db.AllUsers(); err == nil {
-			allUsers = u
-		}
-	}
-
 	priceLimit := NoMoney
 	if p := r.FormValue("price"); p != "" {
 		if pp, err := strconv.Atoi(p); err == nil {
@@ -195,38 +182,10 @@ func getFilterResults(w http.ResponseWriter, r *http.Request, db *Db, store *ses
 		}
 	}
 
-	for _, u := range allUsers {
-		for _, d := range u.AllDecks() {
-			// exclude the deck if it doesn't match the price requirement
-			if priceLimit != NoMoney && d.PriceLimit != priceLimit {
-				continue
-			}
-
-			// exclude the deck if it doesn't match at least one of the search terms
-			haystack := normalizeString(fmt.Sprintf("%s-%s-%s", u.Name, d.Name, d.PriceLimit.String()))
-			matchesSearch := false
-			for _, term := range searchTerms {
-				if strings.Index(haystack, normalizeString(term)) >= 0 {
-					matchesSearch = true
-					break
-				}
-			}
-			if !matchesSearch {
-				continue
-			}
-
-			newDeck := &deckData{d, u}
-
-			// sorted insert
-			insertIdx := 0
-			for insertIdx < len(result.AllDecks) && d.Name > result.AllDecks[insertIdx].Deck.Name {
-				insertIdx++
-			}
-			result.AllDecks = append(
-				result.AllDecks[:insertIdx],
-				append([]*deckData{newDeck}, result.AllDecks[insertIdx:]...)...)
-		}
-	}
+	// globalSearchIndex is kept up to date incrementally by every Db method that
+	// persists a user, so this is an index intersection plus a sorted-list walk
+	// rather than the O(N*M) scan-and-sorted-insert this used to be.
+	result.AllDecks = globalSearchIndex.Search(searchTerms, r.FormValue("user"), priceLimit)
 
 	result.NumPages = (len(result.AllDecks) + (filterResultsPerPage - 1)) / filterResultsPerPage
 
@@ -248,7 +207,7 @@ func getFilterResults(w http.ResponseWriter, r *http.Request, db *Db, store *ses
 	return result
 }
 
-func getStandardTemplateData(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) *templateData {
+func getStandardTemplateData(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) *templateData {
 	searchText := r.FormValue("search")
 	currentUser, _ := findLoggedInUser(w, r, db, store)
 
@@ -257,6 +216,10 @@ func getStandardTemplateData(w http.ResponseWriter, r *http.Request, db *Db, sto
 		SearchText: searchText,
 	}
 
+	if tok, err := ensureCsrfToken(w, r, store); err == nil {
+		data.CSRFToken = tok
+	}
+
 	if msg, ok := getCookie(r, store, "message").(string); ok {
 		data.InfoMessage = msg
 		deleteCookie(w, r, store, "message")
@@ -270,7 +233,7 @@ func getStandardTemplateData(w http.ResponseWriter, r *http.Request, db *Db, sto
 	return data
 }
 
-func renderFilterPage(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func renderFilterPage(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	data := struct {
 		templateData
 		Decks            []*deckData
@@ -309,11 +272,16 @@ func renderFilterPage(w http.ResponseWriter, r *http.Request, db *Db, store *ses
 		}
 	}
 
-	renderTemplate("filter.template", w, &data) // ignore errors since this page is used to display all errors
+	// filter.template is itself what redirectForError sends people back to, so a
+	// template failure here can't be reported by redirecting to "/" without
+	// looping - send a plain 500 instead.
+	if err := renderTemplate("filter.template", w, &data); err != nil {
+		render500(w, err)
+	}
 	return nil
 }
 
-func renderDeckPage(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func renderDeckPage(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	data := struct {
 		templateData
 		Deck           *deckData
@@ -346,7 +314,7 @@ func renderDeckPage(w http.ResponseWriter, r *http.Request, db *Db, store *sessi
 	return renderTemplate("deck.template", w, &data)
 }
 
-func renderSnapshotPage(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func renderSnapshotPage(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	data := struct {
 		templateData
 		Deck     *deckData
@@ -387,7 +355,98 @@ func renderSnapshotPage(w http.ResponseWriter, r *http.Request, db *Db, store *s
 	return renderTemplate("snapshot.template", w, &data)
 }
 
-func performLogin(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+// priceHistoryDefaultRange is how far back to look when the caller doesn't specify
+// a "since" query parameter.
+const priceHistoryDefaultRange = 90 * 24 * time.Hour
+
+func parsePriceHistoryRequest(r *http.Request) (cardId string, since time.Time, err error) {
+	cardId = r.FormValue("card")
+	if cardId == "" {
+		return "", time.Time{}, errors.New("Card id not included")
+	}
+
+	since = time.Now().Add(-priceHistoryDefaultRange)
+	if s := r.FormValue("since"); s != "" {
+		days, err := strconv.Atoi(s)
+		if err != nil {
+			return "", time.Time{}, errors.New("Invalid 'since' parameter")
+		}
+		since = time.Now().AddDate(0, 0, -days)
+	}
+
+	return cardId, since, nil
+}
+
+func renderPriceHistoryJson(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
+	cardId, since, err := parsePriceHistoryRequest(r)
+	if err != nil {
+		return err
+	}
+
+	points, err := db.PriceHistory(cardId, since)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(points)
+}
+
+func renderPriceHistorySparkline(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
+	cardId, since, err := parsePriceHistoryRequest(r)
+	if err != nil {
+		return err
+	}
+
+	points, err := db.PriceHistory(cardId, since)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	return writeSparklineSvg(w, points)
+}
+
+// writeSparklineSvg renders a minimal polyline sparkline of the given points - just
+// enough to flag a trend at a glance, not a full charting library.
+func writeSparklineSvg(w io.Writer, points []PricePoint) error {
+	const width, height = 120, 30
+
+	if len(points) < 2 {
+		_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d"></svg>`, width, height)
+		return err
+	}
+
+	minPrice, maxPrice := points[0].Price, points[0].Price
+	for _, p := range points {
+		if p.Price < minPrice {
+			minPrice = p.Price
+		}
+		if p.Price > maxPrice {
+			maxPrice = p.Price
+		}
+	}
+	priceRange := float64(maxPrice - minPrice)
+	if priceRange == 0 {
+		priceRange = 1
+	}
+
+	coords := make([]string, len(points))
+	for i, p := range points {
+		x := float64(i) / float64(len(points)-1) * width
+		y := height - (float64(p.Price-minPrice)/priceRange)*height
+		coords[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+
+	_, err := fmt.Fprintf(w,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+
+			`<polyline fill="none" stroke="#336699" stroke-width="1.5" points="%s"/>`+
+			`</svg>`,
+		width, height, strings.Join(coords, " "))
+	return err
+}
+
+func performLogin(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
@@ -417,7 +476,7 @@ func performLogin(w http.ResponseWriter, r *http.Request, db *Db, store *session
 	return nil
 }
 
-func performLogout(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performLogout(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	user, err := findLoggedInUser(w, r, db, store)
 	if err != nil {
 		return err
@@ -432,9 +491,10 @@ func performLogout(w http.ResponseWriter, r *http.Request, db *Db, store *sessio
 	return nil
 }
 
-func performAddUser(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performAddUser(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	email := r.FormValue("email")
 
 	if username == "" || password == "" {
 		return errors.New("Username/password not included")
@@ -445,7 +505,7 @@ func performAddUser(w http.ResponseWriter, r *http.Request, db *Db, store *sessi
 		return err
 	}
 
-	user, err := db.AddUser(username, passwordHash)
+	user, err := db.AddUser(username, email, passwordHash)
 	if err != nil {
 		return err
 	}
@@ -463,7 +523,7 @@ func performAddUser(w http.ResponseWriter, r *http.Request, db *Db, store *sessi
 	return nil
 }
 
-func performChangePassword(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performChangePassword(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	password := r.FormValue("password")
 	if password == "" {
 		return errors.New("Password not included")
@@ -484,12 +544,18 @@ func performChangePassword(w http.ResponseWriter, r *http.Request, db *Db, store
 		return err
 	}
 
+	// rotate the session key so any other browser currently logged in as this
+	// user is signed out; updateSessionKey re-issues one for this request
+	if err := updateSessionKey(user, w, r, db, store); err != nil {
+		return err
+	}
+
 	setCookie(w, r, store, "message", "User '"+user.Name+"' password changed successfully!")
 	http.Redirect(w, r, "/", http.StatusFound)
 	return nil
 }
 
-func performDeleteUser(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performDeleteUser(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	user, err := findLoggedInUser(w, r, db, store)
 	if err != nil {
 		return err
@@ -509,7 +575,7 @@ func performDeleteUser(w http.ResponseWriter, r *http.Request, db *Db, store *se
 	return nil
 }
 
-func performAddDeck(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performAddDeck(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	name := r.FormValue("name")
 	price := r.FormValue("price")
 
@@ -527,23 +593,21 @@ func performAddDeck(w http.ResponseWriter, r *http.Request, db *Db, store *sessi
 		return err
 	}
 
-	deck := user.FindDeck(name)
-	if deck != nil {
-		return errors.New("Deck '" + name + "' already exists!")
-	}
-
-	deck = &Deck{name, time.Now(), Money(priceInt), Snapshot{}, []*Snapshot{}}
-	user.Decks = append(user.Decks, deck)
-	err = db.UpdateUser(user)
+	var deck *Deck
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d, err := addDeckService(u, name, Money(priceInt))
+		deck = d
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	http.Redirect(w, r, "/deck?user="+user.NormalizedName()+"&name="+deck.NormalizedName(), http.StatusFound)
+	http.Redirect(w, r, "/deck?user="+user.NormalizedName+"&name="+deck.NormalizedName(), http.StatusFound)
 	return nil
 }
 
-func performModifyDeck(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performModifyDeck(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	origName := r.FormValue("orig-name")
 	newName := r.FormValue("name")
 	price := r.FormValue("price")
@@ -562,27 +626,21 @@ func performModifyDeck(w http.ResponseWriter, r *http.Request, db *Db, store *se
 		return err
 	}
 
-	deck := user.FindDeck(origName)
-	if deck == nil {
-		return errors.New("Deck '" + origName + "' doesn't exist!")
-	}
-
-	if d := user.FindDeck(newName); d != nil && d.Name != deck.Name {
-		return errors.New("Deck '" + newName + "' already exists!")
-	}
-
-	deck.Name = newName
-	deck.PriceLimit = Money(priceInt)
-	err = db.UpdateUser(user)
+	var deck *Deck
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d, err := modifyDeckService(u, origName, newName, Money(priceInt))
+		deck = d
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	http.Redirect(w, r, "/deck?user="+user.NormalizedName()+"&name="+deck.NormalizedName(), http.StatusFound)
+	http.Redirect(w, r, "/deck?user="+user.NormalizedName+"&name="+deck.NormalizedName(), http.StatusFound)
 	return nil
 }
 
-func performDeleteDeck(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performDeleteDeck(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	deckName := r.FormValue("deck")
 
 	if deckName == "" {
@@ -594,20 +652,12 @@ func performDeleteDeck(w http.ResponseWriter, r *http.Request, db *Db, store *se
 		return err
 	}
 
-	deck := user.FindDeck(deckName)
-	if deck == nil {
-		return errors.New("Deck '" + deckName + "' doesn't exist!")
-	}
-
-	newDecks := []*Deck{}
-	for _, d := range user.Decks {
-		if d != deck {
-			newDecks = append(newDecks, d)
-		}
-	}
-
-	user.Decks = newDecks
-	err = db.UpdateUser(user)
+	var deck *Deck
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d, err := deleteDeckService(u, deckName)
+		deck = d
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -617,7 +667,7 @@ func performDeleteDeck(w http.ResponseWriter, r *http.Request, db *Db, store *se
 	return nil
 }
 
-func performUpdateDecklist(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performUpdateDecklist(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	deckName := r.FormValue("deck")
 	commander := r.FormValue("commander")
 	decklist := r.FormValue("decklist")
@@ -638,27 +688,26 @@ func performUpdateDecklist(w http.ResponseWriter, r *http.Request, db *Db, store
 		return errors.New("Deck '" + deckName + "' doesn't exist!")
 	}
 
-	if commander == "" {
-		deck.StagingArea.Commander.IsPresent = false
-	} else {
-		deck.StagingArea.Commander.IsPresent = true
-		deck.StagingArea.Commander.Name = strings.TrimSpace(commander)
-		deck.StagingArea.Commander.Price = Free // not scanned yet
-	}
-
-	deck.StagingArea.Decklist = ParseCardEntryLines(decklist)
-	deck.StagingArea.Sideboard = ParseCardEntryLines(sideboard)
-	deck.StagingArea.IsGrandfatherLegal = (grandfather != "")
+	deckUrl := "/deck?user=" + user.NormalizedName + "&name=" + deck.NormalizedName()
 
-	deckUrl := "/deck?user=" + user.NormalizedName() + "&name=" + deck.NormalizedName()
-	err = deck.StagingArea.CalculatePrices(db)
-	if err != nil {
-		// this is not a fatal error - we need to redirect back to the expected page
-		redirectForError(w, r, store, err, deckUrl)
+	var serviceErr error
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d := u.FindDeck(deckName)
+		if d == nil {
+			return errors.New("Deck '" + deckName + "' doesn't exist!")
+		}
+		if err := updateDecklistService(db, d, strings.TrimSpace(commander), decklist, sideboard, grandfather != ""); err != nil {
+			// this is not a fatal error - skip the commit, remember it, and
+			// redirect back to the expected page once we return
+			serviceErr = err
+			return err
+		}
+		return nil
+	})
+	if serviceErr != nil {
+		redirectForError(w, r, store, serviceErr, deckUrl)
 		return nil
 	}
-
-	err = db.UpdateUser(user)
 	if err != nil {
 		return err
 	}
@@ -667,7 +716,7 @@ func performUpdateDecklist(w http.ResponseWriter, r *http.Request, db *Db, store
 	return nil
 }
 
-func performSaveSnapshot(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performSaveSnapshot(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	deckName := r.FormValue("deck")
 
 	if deckName == "" {
@@ -684,20 +733,23 @@ func performSaveSnapshot(w http.ResponseWriter, r *http.Request, db *Db, store *
 		return errors.New("Deck '" + deckName + "' doesn't exist!")
 	}
 
-	snap := deck.StagingArea.Clone()
-	snap.Date = time.Now()
-	deck.Snapshots = append(deck.Snapshots, snap)
-
-	err = db.UpdateUser(user)
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d := u.FindDeck(deckName)
+		if d == nil {
+			return errors.New("Deck '" + deckName + "' doesn't exist!")
+		}
+		saveSnapshotService(d)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	http.Redirect(w, r, "/deck?user="+user.NormalizedName()+"&name="+deck.NormalizedName(), http.StatusFound)
+	http.Redirect(w, r, "/deck?user="+user.NormalizedName+"&name="+deck.NormalizedName(), http.StatusFound)
 	return nil
 }
 
-func performRevertChanges(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performRevertChanges(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	deckName := r.FormValue("deck")
 
 	if deckName == "" {
@@ -714,22 +766,87 @@ func performRevertChanges(w http.ResponseWriter, r *http.Request, db *Db, store
 		return errors.New("Deck '" + deckName + "' doesn't exist!")
 	}
 
-	if len(deck.Snapshots) == 0 {
-		return errors.New("Deck has no snapshots!")
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d := u.FindDeck(deckName)
+		if d == nil {
+			return errors.New("Deck '" + deckName + "' doesn't exist!")
+		}
+		return revertChangesService(d)
+	})
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/deck?user="+user.NormalizedName+"&name="+deck.NormalizedName(), http.StatusFound)
+	return nil
+}
+
+// performScheduleChange queues a PriceLimit and/or GrandfatherLegal change for
+// some future date, rather than changing it immediately the way
+// performModifyDeck does. "effective-at" is a plain "2006-01-02" date; "price"
+// and "grandfather" ("true"/"false") are each optional, but at least one must
+// be given.
+func performScheduleChange(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
+	deckName := r.FormValue("deck")
+	effectiveAtStr := r.FormValue("effective-at")
+	price := r.FormValue("price")
+	grandfather := r.FormValue("grandfather")
+
+	if deckName == "" || effectiveAtStr == "" {
+		return errors.New("Deck name/effective date not included")
+	}
+
+	effectiveAt, err := time.Parse("2006-01-02", effectiveAtStr)
+	if err != nil {
+		return errors.New("Invalid effective date")
+	}
+
+	var newPriceLimit *Money
+	if price != "" {
+		priceInt, err := strconv.Atoi(price)
+		if err != nil {
+			return errors.New("Price incorrectly formatted")
+		}
+		limit := Money(priceInt)
+		newPriceLimit = &limit
 	}
 
-	deck.StagingArea = *deck.Snapshots[len(deck.Snapshots)-1].Clone()
+	var newGrandfather *bool
+	switch grandfather {
+	case "true":
+		v := true
+		newGrandfather = &v
+	case "false":
+		v := false
+		newGrandfather = &v
+	}
 
-	err = db.UpdateUser(user)
+	user, err := findLoggedInUser(w, r, db, store)
 	if err != nil {
 		return err
 	}
 
-	http.Redirect(w, r, "/deck?user="+user.NormalizedName()+"&name="+deck.NormalizedName(), http.StatusFound)
+	deck := user.FindDeck(deckName)
+	if deck == nil {
+		return errors.New("Deck '" + deckName + "' doesn't exist!")
+	}
+
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d := u.FindDeck(deckName)
+		if d == nil {
+			return errors.New("Deck '" + deckName + "' doesn't exist!")
+		}
+		return scheduleDeckChangeService(d, effectiveAt, newPriceLimit, newGrandfather)
+	})
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/deck?user="+user.NormalizedName+"&name="+deck.NormalizedName(), http.StatusFound)
 	return nil
 }
 
-func performClearHistory(w http.ResponseWriter, r *http.Request, db *Db, store *sessions.CookieStore) error {
+func performClearHistory(w http.ResponseWriter, r *http.Request, db *Db, store SessionStore) error {
 	deckName := r.FormValue("deck")
 
 	if deckName == "" {
@@ -746,12 +863,18 @@ func performClearHistory(w http.ResponseWriter, r *http.Request, db *Db, store *
 		return errors.New("Deck '" + deckName + "' doesn't exist!")
 	}
 
-	deck.Snapshots = []*Snapshot{}
-	err = db.UpdateUser(user)
+	_, err = db.UpdateUserFunc(user.Name, func(u *User) error {
+		d := u.FindDeck(deckName)
+		if d == nil {
+			return errors.New("Deck '" + deckName + "' doesn't exist!")
+		}
+		clearHistoryService(d)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	http.Redirect(w, r, "/deck?user="+user.NormalizedName()+"&name="+deck.NormalizedName(), http.StatusFound)
+	http.Redirect(w, r, "/deck?user="+user.NormalizedName+"&name="+deck.NormalizedName(), http.StatusFound)
 	return nil
 }
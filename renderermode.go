@@ -0,0 +1,16 @@
+package donkeytownsfolk
+
+// RendererMode selects how a PriceSource's pages get fetched. Most shops can be
+// scraped as plain static HTML, but some (TCGPlayer included, increasingly) render
+// prices client-side via JavaScript that goquery can't see.
+type RendererMode int
+
+const (
+	// ModeStatic fetches and parses the page as-is (the historical behavior).
+	ModeStatic RendererMode = iota
+
+	// ModeHeadless renders the page in a headless Chrome instance first, then hands
+	// the resulting HTML to the same goquery parsing path. Requires the server to be
+	// built with the "headless" build tag; see headlessbrowser.go.
+	ModeHeadless
+)
@@ -0,0 +1,318 @@
+package donkeytownsfolk
+
+import (
+	"strings"
+	"sync"
+)
+
+// searchIndex is an in-memory inverted index over every deck in the database,
+// kept incrementally up to date as users/decks are added, modified, deleted,
+// and snapshotted. getFilterResults used to rebuild a sorted list from scratch
+// on every single request via an O(N*M) substring scan plus an O(N) sorted
+// insert; this instead keeps a skip list (for the always-sorted-by-name deck
+// listing) and token/trigram posting lists (for search) that are patched in
+// place by whichever mutation touched a deck, so a request only needs to
+// intersect postings and walk the already-sorted skip list.
+type searchIndex struct {
+	mu sync.Mutex
+
+	order       *skipList                  // sort key ("name\x00deckKey") -> *deckData, always in deck-name order
+	tokens      map[string]map[string]bool // whole word -> set of deckKeys
+	trigrams    map[string]map[string]bool // 3-char substring -> set of deckKeys
+	haystacks   map[string]string          // deckKey -> normalized haystack (for exact verification)
+	wordsOf     map[string][]string        // deckKey -> words indexed for it (so we can clean up on re-index)
+	sortKeyOf   map[string]string          // deckKey -> the key it's currently stored under in `order`
+	keysForUser map[string]map[string]bool // user's NormalizedName -> set of deckKeys currently indexed for them
+}
+
+var globalSearchIndex = newSearchIndex()
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		order:       newSkipList(),
+		tokens:      map[string]map[string]bool{},
+		trigrams:    map[string]map[string]bool{},
+		haystacks:   map[string]string{},
+		wordsOf:     map[string][]string{},
+		sortKeyOf:   map[string]string{},
+		keysForUser: map[string]map[string]bool{},
+	}
+}
+
+func deckIndexKey(u *User, d *Deck) string {
+	return u.NormalizedName + "/" + d.NormalizedName()
+}
+
+// deckHaystack builds the normalized text a deck is matched against. It starts
+// with the same three fields getFilterResults always searched (user name, deck
+// name, price limit) so existing searches keep matching exactly what they used
+// to, then also folds in the commander and decklist card names so a search for
+// a card turns up the decks that run it.
+func deckHaystack(u *User, d *Deck) string {
+	fields := []string{u.Name, d.Name, d.PriceLimit.String()}
+	if snap := d.CurrentPriceSnapshot(); snap != nil {
+		if snap.Commander.IsPresent {
+			fields = append(fields, snap.Commander.Name)
+		}
+		for _, c := range snap.Decklist {
+			fields = append(fields, c.Name)
+		}
+	}
+	return normalizeString(strings.Join(fields, "-"))
+}
+
+func trigramsOf(s string) []string {
+	if len(s) < 3 {
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
+	ret := make([]string, 0, len(s)-2)
+	for i := 0; i+3 <= len(s); i++ {
+		ret = append(ret, s[i:i+3])
+	}
+	return ret
+}
+
+func addToPostings(postings map[string]map[string]bool, term string, key string) {
+	set, ok := postings[term]
+	if !ok {
+		set = map[string]bool{}
+		postings[term] = set
+	}
+	set[key] = true
+}
+
+func removeFromPostings(postings map[string]map[string]bool, term string, key string) {
+	set, ok := postings[term]
+	if !ok {
+		return
+	}
+	delete(set, key)
+	if len(set) == 0 {
+		delete(postings, term)
+	}
+}
+
+// Upsert (re-)indexes a single deck, replacing any previous postings for it.
+func (idx *searchIndex) Upsert(u *User, d *Deck) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.upsertLocked(u, d)
+}
+
+func (idx *searchIndex) upsertLocked(u *User, d *Deck) {
+	key := deckIndexKey(u, d)
+	idx.removeLocked(key)
+
+	haystack := deckHaystack(u, d)
+	words := []string{}
+	for _, w := range strings.Split(haystack, "-") {
+		if w != "" {
+			words = append(words, w)
+		}
+	}
+
+	idx.haystacks[key] = haystack
+	idx.wordsOf[key] = words
+
+	sortKey := d.Name + "\x00" + key
+	idx.sortKeyOf[key] = sortKey
+	idx.order.Insert(sortKey, &deckData{d, u})
+
+	for _, w := range words {
+		addToPostings(idx.tokens, w, key)
+		for _, t := range trigramsOf(w) {
+			addToPostings(idx.trigrams, t, key)
+		}
+	}
+}
+
+// Remove drops a single deck from the index (used when a deck is deleted).
+func (idx *searchIndex) Remove(u *User, d *Deck) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(deckIndexKey(u, d))
+}
+
+func (idx *searchIndex) removeLocked(key string) {
+	words, ok := idx.wordsOf[key]
+	if !ok {
+		return
+	}
+	for _, w := range words {
+		removeFromPostings(idx.tokens, w, key)
+		for _, t := range trigramsOf(w) {
+			removeFromPostings(idx.trigrams, t, key)
+		}
+	}
+	if sortKey, ok := idx.sortKeyOf[key]; ok {
+		idx.order.Delete(sortKey)
+	}
+	delete(idx.wordsOf, key)
+	delete(idx.haystacks, key)
+	delete(idx.sortKeyOf, key)
+}
+
+// SyncUser re-indexes every deck currently on user, and drops any decks that
+// were indexed for them previously but are no longer present (renamed or
+// deleted). This is the hook called from every Db method that persists a
+// User, so the index never needs a full rebuild except at startup.
+func (idx *searchIndex) SyncUser(u *User) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	normName := u.NormalizedName
+	prevKeys := idx.keysForUser[normName]
+	newKeys := map[string]bool{}
+
+	for _, d := range u.Decks {
+		key := deckIndexKey(u, d)
+		newKeys[key] = true
+		idx.upsertLocked(u, d)
+	}
+
+	for key := range prevKeys {
+		if !newKeys[key] {
+			idx.removeLocked(key)
+		}
+	}
+
+	idx.keysForUser[normName] = newKeys
+}
+
+// RemoveUser drops every deck indexed for user (used when the user itself is deleted).
+func (idx *searchIndex) RemoveUser(u *User) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	normName := u.NormalizedName
+	for key := range idx.keysForUser[normName] {
+		idx.removeLocked(key)
+	}
+	delete(idx.keysForUser, normName)
+}
+
+// matchingKeysLocked returns the set of deckKeys whose haystack contains at
+// least one of searchTerms as a substring, mirroring the OR-of-terms substring
+// match getFilterResults always did (an empty term, as produced by an empty
+// search box, matches everything).
+func (idx *searchIndex) matchingKeysLocked(searchTerms []string) map[string]bool {
+	matched := map[string]bool{}
+	for _, term := range searchTerms {
+		norm := normalizeString(term)
+		if norm == "" {
+			for key := range idx.haystacks {
+				matched[key] = true
+			}
+			return matched
+		}
+		for key := range idx.candidateKeysLocked(norm) {
+			matched[key] = true
+		}
+	}
+	return matched
+}
+
+// candidateKeysLocked finds every deckKey whose haystack contains norm. Terms
+// of 3 or more characters go through the trigram index (intersect the
+// postings of each trigram in norm, then verify the surviving candidates
+// really do contain norm, since trigram overlap alone isn't sufficient).
+// Shorter terms fall back to a direct scan, since a 1-2 character trigram
+// isn't selective enough to be worth indexing. So do terms containing "-",
+// since trigrams are only indexed within single words and one spanning a
+// word boundary would never be found.
+func (idx *searchIndex) candidateKeysLocked(norm string) map[string]bool {
+	if len(norm) < 3 || strings.Contains(norm, "-") {
+		ret := map[string]bool{}
+		for key, haystack := range idx.haystacks {
+			if strings.Contains(haystack, norm) {
+				ret[key] = true
+			}
+		}
+		return ret
+	}
+
+	grams := trigramsOf(norm)
+	var candidates map[string]bool
+	for _, g := range grams {
+		posting := idx.trigrams[g]
+		if posting == nil {
+			return map[string]bool{}
+		}
+		if candidates == nil {
+			candidates = map[string]bool{}
+			for key := range posting {
+				candidates[key] = true
+			}
+			continue
+		}
+		for key := range candidates {
+			if !posting[key] {
+				delete(candidates, key)
+			}
+		}
+	}
+
+	ret := map[string]bool{}
+	for key := range candidates {
+		if strings.Contains(idx.haystacks[key], norm) {
+			ret[key] = true
+		}
+	}
+	return ret
+}
+
+// Search returns every indexed deck matching searchTerms (OR'd together, same
+// as getFilterResults), optionally restricted to one user and/or one price
+// limit, in ascending deck-name order.
+func (idx *searchIndex) Search(searchTerms []string, username string, priceLimit Money) []*deckData {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	matched := idx.matchingKeysLocked(searchTerms)
+	normUser := normalizeString(username)
+
+	ret := []*deckData{}
+	for _, dd := range idx.order.All() {
+		key := deckIndexKey(dd.User, dd.Deck)
+		if !matched[key] {
+			continue
+		}
+		if normUser != "" && dd.User.NormalizedName != normUser {
+			continue
+		}
+		if priceLimit != NoMoney && dd.Deck.PriceLimit != priceLimit {
+			continue
+		}
+		ret = append(ret, dd)
+	}
+	return ret
+}
+
+// RebuildSearchIndex throws away the in-memory index and rebuilds it from
+// every user currently in the database. Called once at startup from OpenDb;
+// every mutation after that keeps the index in sync incrementally.
+func RebuildSearchIndex(db *Db) error {
+	users, err := db.AllUsers()
+	if err != nil {
+		return err
+	}
+
+	fresh := newSearchIndex()
+	for _, u := range users {
+		fresh.SyncUser(u)
+	}
+
+	globalSearchIndex.mu.Lock()
+	defer globalSearchIndex.mu.Unlock()
+	globalSearchIndex.order = fresh.order
+	globalSearchIndex.tokens = fresh.tokens
+	globalSearchIndex.trigrams = fresh.trigrams
+	globalSearchIndex.haystacks = fresh.haystacks
+	globalSearchIndex.wordsOf = fresh.wordsOf
+	globalSearchIndex.sortKeyOf = fresh.sortKeyOf
+	globalSearchIndex.keysForUser = fresh.keysForUser
+	return nil
+}
@@ -0,0 +1,97 @@
+package donkeytownsfolk
+
+import "testing"
+
+func newTestUser(name string) *User {
+	return &User{Name: name, NormalizedName: normalizeString(name)}
+}
+
+func newTestDeck(name string, price Money) *Deck {
+	return &Deck{Name: name, PriceLimit: price}
+}
+
+func searchKeys(idx *searchIndex, terms []string) []string {
+	ret := []string{}
+	for _, dd := range idx.Search(terms, "", NoMoney) {
+		ret = append(ret, deckIndexKey(dd.User, dd.Deck))
+	}
+	return ret
+}
+
+// TestSearchRankingStability checks that decks sharing a name (a tie on the
+// primary sort key) always come back in the same order - ascending by owner,
+// the skip list's secondary sort key - regardless of the order they were
+// indexed in. getFilterResults's old sorted-insert broke these ties by
+// insertion order instead, which made the result page order depend on
+// request-to-request iteration order of the user collection.
+func TestSearchRankingStability(t *testing.T) {
+	amy := newTestUser("amy")
+	zed := newTestUser("zed")
+
+	idx := newSearchIndex()
+	idx.Upsert(zed, newTestDeck("Aggro", 50))
+	idx.Upsert(amy, newTestDeck("Aggro", 50))
+
+	got := searchKeys(idx, []string{""})
+	want := []string{deckIndexKey(amy, newTestDeck("Aggro", 50)), deckIndexKey(zed, newTestDeck("Aggro", 50))}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// re-index in the opposite order - the tie-break must not depend on it
+	idx2 := newSearchIndex()
+	idx2.Upsert(amy, newTestDeck("Aggro", 50))
+	idx2.Upsert(zed, newTestDeck("Aggro", 50))
+
+	got2 := searchKeys(idx2, []string{""})
+	if len(got2) != 2 || got2[0] != want[0] || got2[1] != want[1] {
+		t.Fatalf("got %v, want %v", got2, want)
+	}
+}
+
+// TestSearchQueryTermNormalization checks that search terms are normalized the
+// same way the indexed text is, so a query's case and punctuation don't affect
+// whether it matches - the same equivalence getFilterResults's
+// strings.Index(haystack, normalizeString(term)) gave for free.
+func TestSearchQueryTermNormalization(t *testing.T) {
+	user := newTestUser("Alice")
+	idx := newSearchIndex()
+	idx.Upsert(user, newTestDeck("Mono Red Aggro", 100))
+
+	cases := []struct {
+		name string
+		term string
+		want bool
+	}{
+		{"exact case", "Aggro", true},
+		{"different case", "AGGRO", true},
+		{"mixed case word substring", "gGr", true},
+		{"short term (below trigram threshold)", "Re", true},
+		{"single char term", "M", true},
+		{"no match", "control", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := len(searchKeys(idx, []string{c.term})) == 1
+			if got != c.want {
+				t.Errorf("search(%q): got match=%v, want %v", c.term, got, c.want)
+			}
+		})
+	}
+}
+
+// TestSearchQueryTermNormalizationMultiWordTrigram checks the >=3-char path,
+// which goes through the trigram posting lists instead of the haystack's plain
+// Contains fallback used for 1-2 char terms - both must agree on a match.
+func TestSearchQueryTermNormalizationMultiWordTrigram(t *testing.T) {
+	user := newTestUser("bob")
+	idx := newSearchIndex()
+	idx.Upsert(user, newTestDeck("Selesnya Tokens", 75))
+	idx.Upsert(user, newTestDeck("Izzet Spells", 75))
+
+	got := searchKeys(idx, []string{"tokens"})
+	if len(got) != 1 || got[0] != deckIndexKey(user, newTestDeck("Selesnya Tokens", 75)) {
+		t.Fatalf("expected only the Tokens deck to match, got %v", got)
+	}
+}
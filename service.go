@@ -0,0 +1,107 @@
+package donkeytownsfolk
+
+import (
+	"errors"
+	"time"
+)
+
+// This file factors the deck-mutation logic shared by the HTML perform* handlers
+// in renderer.go and the JSON handlers in api.go into a single service layer, so
+// the two surfaces can't drift apart on validation or side effects.
+
+func addDeckService(user *User, name string, price Money) (*Deck, error) {
+	if user.FindDeck(name) != nil {
+		return nil, errors.New("Deck '" + name + "' already exists!")
+	}
+
+	deck := &Deck{name, time.Now(), price, Snapshot{}, []*Snapshot{}, false, []*PendingChange{}}
+	user.Decks = append(user.Decks, deck)
+	return deck, nil
+}
+
+func modifyDeckService(user *User, origName string, newName string, price Money) (*Deck, error) {
+	deck := user.FindDeck(origName)
+	if deck == nil {
+		return nil, errors.New("Deck '" + origName + "' doesn't exist!")
+	}
+
+	if d := user.FindDeck(newName); d != nil && d.Name != deck.Name {
+		return nil, errors.New("Deck '" + newName + "' already exists!")
+	}
+
+	deck.Name = newName
+	deck.PriceLimit = price
+	return deck, nil
+}
+
+func deleteDeckService(user *User, deckName string) (*Deck, error) {
+	deck := user.FindDeck(deckName)
+	if deck == nil {
+		return nil, errors.New("Deck '" + deckName + "' doesn't exist!")
+	}
+
+	newDecks := []*Deck{}
+	for _, d := range user.Decks {
+		if d != deck {
+			newDecks = append(newDecks, d)
+		}
+	}
+	user.Decks = newDecks
+	return deck, nil
+}
+
+func updateDecklistService(db *Db, deck *Deck, commander string, decklist string, sideboard string, grandfather bool) error {
+	if commander == "" {
+		deck.StagingArea.Commander.IsPresent = false
+	} else {
+		deck.StagingArea.Commander.IsPresent = true
+		deck.StagingArea.Commander.Name = commander
+		deck.StagingArea.Commander.Price = Free // not scanned yet
+	}
+
+	deck.StagingArea.Decklist = ParseCardEntryLines(decklist)
+	deck.StagingArea.Sideboard = ParseCardEntryLines(sideboard)
+	deck.StagingArea.IsGrandfatherLegal = grandfather
+
+	deck.StagingArea.CalculatePrices(db)
+	return nil
+}
+
+func saveSnapshotService(deck *Deck) *Snapshot {
+	snap := deck.StagingArea.Clone()
+	snap.Date = time.Now()
+	deck.Snapshots = append(deck.Snapshots, snap)
+	return snap
+}
+
+func revertChangesService(deck *Deck) error {
+	if len(deck.Snapshots) == 0 {
+		return errors.New("Deck has no snapshots!")
+	}
+	deck.StagingArea = *deck.Snapshots[len(deck.Snapshots)-1].Clone()
+	return nil
+}
+
+func clearHistoryService(deck *Deck) {
+	deck.Snapshots = []*Snapshot{}
+}
+
+// scheduleDeckChangeService queues a PriceLimit and/or GrandfatherLegal change
+// to take effect at effectiveAt, rather than applying it immediately. At least
+// one of newPriceLimit/newGrandfather must be set, and effectiveAt must be in
+// the future - an immediate change should go through modifyDeckService instead.
+func scheduleDeckChangeService(deck *Deck, effectiveAt time.Time, newPriceLimit *Money, newGrandfather *bool) error {
+	if newPriceLimit == nil && newGrandfather == nil {
+		return errors.New("No change specified")
+	}
+	if !effectiveAt.After(time.Now()) {
+		return errors.New("Effective date must be in the future")
+	}
+
+	deck.PendingChanges = append(deck.PendingChanges, &PendingChange{
+		EffectiveAt:    effectiveAt,
+		NewPriceLimit:  newPriceLimit,
+		NewGrandfather: newGrandfather,
+	})
+	return nil
+}
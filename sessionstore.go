@@ -0,0 +1,60 @@
+package donkeytownsfolk
+
+import (
+	"fmt"
+	"github.com/boj/redistore"
+	"github.com/gorilla/sessions"
+	"os"
+)
+
+// SessionStore is whatever the configured session backend implements. It's
+// exactly gorilla/sessions.Store, aliased here so the rest of the package
+// depends on this name rather than the backing library, and so that it's
+// obvious at a glance which functions take a session store.
+type SessionStore = sessions.Store
+
+const (
+	sessionBackendEnv   = "DT_SESSION_BACKEND"
+	redisAddrEnv        = "DT_REDIS_ADDR"
+	redisPasswordEnv    = "DT_REDIS_PASSWORD"
+	filesystemDirEnv    = "DT_SESSION_DIR"
+	defaultRedisAddr    = "127.0.0.1:6379"
+	defaultFsSessionDir = "/tmp/donkeytownsfolk-sessions"
+)
+
+// NewSessionStore picks a session backend based on DT_SESSION_BACKEND:
+//   - "" or "cookie" (the default): the existing client-side gorilla cookie store
+//   - "filesystem": sessions live as files under DT_SESSION_DIR (or a temp dir)
+//   - "redis": sessions live in Redis at DT_REDIS_ADDR, authenticated via DT_REDIS_PASSWORD
+//
+// Moving off the cookie backend keeps session data on the server and avoids
+// the cookie size limit once sessions start carrying more than a username and
+// a key. Whatever the backend, a user's other sessions are invalidated by
+// rotating the per-user SessionKey (performChangePassword) or by deleting the
+// user (performDeleteUser); stored sessions themselves are not deleted.
+func NewSessionStore() (SessionStore, error) {
+	switch backend := os.Getenv(sessionBackendEnv); backend {
+	case "", "cookie":
+		return sessions.NewCookieStore(masterKey()), nil
+
+	case "filesystem":
+		dir := os.Getenv(filesystemDirEnv)
+		if dir == "" {
+			dir = defaultFsSessionDir
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return sessions.NewFilesystemStore(dir, masterKey()), nil
+
+	case "redis":
+		addr := os.Getenv(redisAddrEnv)
+		if addr == "" {
+			addr = defaultRedisAddr
+		}
+		return redistore.NewRediStore(10, "tcp", addr, os.Getenv(redisPasswordEnv), masterKey())
+
+	default:
+		return nil, fmt.Errorf("unknown %s: %q", sessionBackendEnv, backend)
+	}
+}
@@ -0,0 +1,103 @@
+package donkeytownsfolk
+
+// skipList is a minimal ordered map keyed by string, used by the search index to
+// keep all decks available in sorted (deck name) order without re-sorting on every
+// request the way the old sorted-insert filterResult code did.
+type skipList struct {
+	head  *skipListNode
+	level int
+}
+
+type skipListNode struct {
+	key     string
+	value   *deckData
+	forward []*skipListNode
+}
+
+const (
+	skipListMaxLevel = 16
+	skipListP        = 0.5
+)
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipListNode{forward: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+func (s *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && random.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// Insert adds value under key, replacing any existing value for the same key.
+func (s *skipList) Insert(key string, value *deckData) {
+	update := make([]*skipListNode, skipListMaxLevel)
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && x.forward[i].key < key {
+			x = x.forward[i]
+		}
+		update[i] = x
+	}
+
+	if next := x.forward[0]; next != nil && next.key == key {
+		next.value = value
+		return
+	}
+
+	lvl := s.randomLevel()
+	if lvl > s.level {
+		for i := s.level; i < lvl; i++ {
+			update[i] = s.head
+		}
+		s.level = lvl
+	}
+
+	node := &skipListNode{key: key, value: value, forward: make([]*skipListNode, lvl)}
+	for i := 0; i < lvl; i++ {
+		node.forward[i] = update[i].forward[i]
+		update[i].forward[i] = node
+	}
+}
+
+// Delete removes key, if present.
+func (s *skipList) Delete(key string) {
+	update := make([]*skipListNode, skipListMaxLevel)
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && x.forward[i].key < key {
+			x = x.forward[i]
+		}
+		update[i] = x
+	}
+
+	target := x.forward[0]
+	if target == nil || target.key != key {
+		return
+	}
+
+	for i := 0; i < s.level; i++ {
+		if update[i].forward[i] != target {
+			break
+		}
+		update[i].forward[i] = target.forward[i]
+	}
+
+	for s.level > 1 && s.head.forward[s.level-1] == nil {
+		s.level--
+	}
+}
+
+// All returns every value in ascending key order.
+func (s *skipList) All() []*deckData {
+	ret := []*deckData{}
+	for x := s.head.forward[0]; x != nil; x = x.forward[0] {
+		ret = append(ret, x.value)
+	}
+	return ret
+}
@@ -0,0 +1,167 @@
+package donkeytownsfolk
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// embeddedAssets bundles templates/ and static/ into the binary, so it can run
+// without a $GOPATH checkout. It's only consulted when the on-disk copies
+// (preferred, since they support DT_TEMPLATE_RELOAD) aren't present.
+//
+//go:embed templates static
+var embeddedAssets embed.FS
+
+const templateReloadEnv = "DT_TEMPLATE_RELOAD"
+
+// layoutFiles are parsed alongside every page template, each as a template
+// named after its file, which pages include whole with
+// {{template "header.template" .}} / {{template "footer.template" .}}. They
+// define no {{block}}s, so a page cannot override part of the page chrome.
+var layoutFiles = []string{"header.template", "footer.template"}
+
+// TemplateRegistry precompiles every page template together with the shared
+// layout and caches the result, so rendering a page is just Execute-ing an
+// already-parsed template instead of re-parsing header/footer/page from disk
+// on every single request. Setting DT_TEMPLATE_RELOAD=1 trades that caching
+// for a stat-and-reparse-on-change check, for local development.
+type TemplateRegistry struct {
+	mu       sync.Mutex
+	reload   bool
+	compiled map[string]*compiledTemplate
+}
+
+type compiledTemplate struct {
+	tmpl     *template.Template
+	modTimes map[string]time.Time // source file -> mtime, to detect changes under DT_TEMPLATE_RELOAD
+}
+
+var templates = newTemplateRegistry()
+
+func newTemplateRegistry() *TemplateRegistry {
+	return &TemplateRegistry{
+		reload:   os.Getenv(templateReloadEnv) == "1",
+		compiled: map[string]*compiledTemplate{},
+	}
+}
+
+func templateRoot() string {
+	return os.ExpandEnv("$GOPATH/src/github.com/garbotron/donkeytownsfolk/templates")
+}
+
+// readTemplateFile returns the contents of a template file and, if it came
+// from disk, its mtime (the zero Time otherwise - the embedded copy only
+// changes when the binary is rebuilt, so there's nothing to compare against).
+func readTemplateFile(name string) ([]byte, time.Time, error) {
+	diskPath := path.Join(templateRoot(), name)
+	if info, err := os.Stat(diskPath); err == nil {
+		body, err := os.ReadFile(diskPath)
+		return body, info.ModTime(), err
+	}
+
+	body, err := embeddedAssets.ReadFile(path.Join("templates", name))
+	return body, time.Time{}, err
+}
+
+// Render executes the named page template (plus the shared layout) into w.
+func (t *TemplateRegistry) Render(name string, w io.Writer, data interface{}) error {
+	t.mu.Lock()
+	tmpl, err := t.getLocked(name)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, data)
+}
+
+func (t *TemplateRegistry) getLocked(name string) (*template.Template, error) {
+	if cached, ok := t.compiled[name]; ok && !t.isStaleLocked(cached) {
+		return cached.tmpl, nil
+	}
+
+	files := append([]string{name}, layoutFiles...)
+	tmpl := template.New(name)
+	modTimes := map[string]time.Time{}
+
+	for _, f := range files {
+		body, modTime, err := readTemplateFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("loading template %s: %s", f, err.Error())
+		}
+		modTimes[f] = modTime
+
+		parseName := f
+		if f == name {
+			// parse the page itself as "name" (what Render looks up) and as its own
+			// file name, so it can both be the entry point and be {{template}}d by name
+			if _, err := tmpl.Parse(string(body)); err != nil {
+				return nil, fmt.Errorf("parsing template %s: %s", f, err.Error())
+			}
+			continue
+		}
+
+		if _, err := tmpl.New(parseName).Parse(string(body)); err != nil {
+			return nil, fmt.Errorf("parsing template %s: %s", f, err.Error())
+		}
+	}
+
+	compiled := &compiledTemplate{tmpl: tmpl, modTimes: modTimes}
+	t.compiled[name] = compiled
+	return tmpl, nil
+}
+
+// isStaleLocked only does any work in DT_TEMPLATE_RELOAD mode: it's a no-op
+// stat check per file, so this doesn't slow down the common production path.
+func (t *TemplateRegistry) isStaleLocked(cached *compiledTemplate) bool {
+	if !t.reload {
+		return false
+	}
+	for f, modTime := range cached.modTimes {
+		if modTime.IsZero() {
+			// came from the embedded FS last time - nothing on disk to watch
+			continue
+		}
+		info, err := os.Stat(path.Join(templateRoot(), f))
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func renderTemplate(name string, w io.Writer, data interface{}) error {
+	return templates.Render(name, w, data)
+}
+
+// render500 writes a plain-text 500 response directly, bypassing the normal
+// redirectForError flow - that flow redirects back to "/", which is rendered
+// by renderFilterPage itself, so a template failure there can't be reported
+// by redirecting to "/" without looping.
+func render500(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, "Internal server error: %s\n", err.Error())
+}
+
+// staticFileSystem serves /static out of the on-disk checkout if present,
+// falling back to the files embedded at build time otherwise.
+func staticFileSystem() http.FileSystem {
+	localStaticRoot := os.ExpandEnv("$GOPATH/src/github.com/garbotron/donkeytownsfolk/static")
+	if info, err := os.Stat(localStaticRoot); err == nil && info.IsDir() {
+		return http.Dir(localStaticRoot)
+	}
+
+	sub, err := fs.Sub(embeddedAssets, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
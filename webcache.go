@@ -0,0 +1,88 @@
+package donkeytownsfolk
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// webCache is an on-disk, TTL'd cache of raw HTTP response bodies, keyed by URL.
+// It sits in front of httpFetcher so iterating on a new source's selectors doesn't
+// require re-hitting the real site for every tweak, and so a scrape that produced a
+// bad SourceStats.LastError can be replayed deterministically while diagnosing it.
+// The TTL itself isn't fixed per cache: callers pass it in on each get, since it
+// should track the PriceSource actually making the request (see WithCacheTTL).
+type webCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// defaultCacheTTL mirrors DefaultSourceInterval, the fallback used when a request
+// doesn't carry its source's own Interval() via WithCacheTTL.
+var defaultCacheTTL = DefaultSourceInterval
+
+func newWebCache(dir string) *webCache {
+	return &webCache{dir: dir, ttl: defaultCacheTTL}
+}
+
+func (c *webCache) path(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".html")
+}
+
+// get returns the cached body for url, and true, if an entry fresher than ttl
+// exists. It returns false on a miss, an entry older than ttl, or any read error.
+func (c *webCache) get(url string, ttl time.Duration) ([]byte, bool) {
+	path := c.path(url)
+
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > ttl {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// put writes body to the cache for url, creating the cache directory if needed.
+func (c *webCache) put(url string, body []byte) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(url), body, 0644)
+}
+
+// purge removes every cached entry.
+func (c *webCache) purge() error {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		if err := os.Remove(filepath.Join(c.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeScrapeCache deletes every page cached by the shared scraper fetcher, forcing
+// the next scrape of each source to hit the real site instead of replaying cached
+// HTML. Useful when iterating on a source's selectors, or after fixing a parse
+// failure recorded in a source's SourceStats.LastError.
+func (db *Db) PurgeScrapeCache() error {
+	if fetcher.cache == nil {
+		return nil
+	}
+	return fetcher.cache.purge()
+}